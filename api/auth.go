@@ -0,0 +1,185 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// An API key allowed to make requests to dapper, read from the `APIKeys` array of the config file
+type APIKey struct {
+	// Name the key is identified by in job records, the key itself is never stored with a job
+	Name   string   `mapstructure:"Name"`
+	Key    string   `mapstructure:"Key"`
+	Scopes []string `mapstructure:"Scopes"`
+
+	// Limits on the key's usage, 0 is unlimited
+	MaxConcurrentJobs int `mapstructure:"MaxConcurrentJobs"`
+	// Size with units (ex. "50GB")
+	MaxUploadBytesPerDay        string  `mapstructure:"MaxUploadBytesPerDay"`
+	MaxTranscodeMinutesPerMonth float64 `mapstructure:"MaxTranscodeMinutesPerMonth"`
+	// Height of the highest rendition the key's videos are transcoded to (ex. 1080)
+	MaxRenditionHeight int64 `mapstructure:"MaxRenditionHeight"`
+
+	maxUploadBytesPerDay int64
+}
+
+// Permissions that can be granted to an API key
+const (
+	// Upload videos and thumbnails
+	ScopeUpload = "upload"
+	// Check the status of and list the key's own jobs
+	ScopeStatus = "status"
+	// Cancel and delete the key's own jobs
+	ScopeDelete = "delete"
+	// Add videos and thumbnails from dapper's filesystem by their path, along with the upload scope
+	ScopeLocal = "local"
+	// Every permission, for the jobs of every key
+	ScopeAdmin = "admin"
+)
+
+// Secrets from examples that must never be accepted, since anyone can read them
+var placeholderSecrets = []string{"change-me", "changeme", "change-me-too", "secret", "password", "example"}
+
+// Context key the authenticated API key is stored under
+const apiKeyContextKey = "apiKey"
+
+// API keys allowed to make requests.
+// If no keys are configured, authentication is disabled.
+var apiKeys []APIKey
+
+// Reads the API keys from the config file
+func loadAPIKeys() error {
+	keys := []APIKey{}
+	if err := viper.UnmarshalKey("APIKeys", &keys); err != nil {
+		return err
+	}
+
+	for i := range keys {
+		if isPlaceholderSecret(keys[i].Key) {
+			return fmt.Errorf("API key %q uses the placeholder Key %q, set it to a random secret", keys[i].Name, keys[i].Key)
+		}
+
+		if keys[i].MaxUploadBytesPerDay == "" {
+			continue
+		}
+		maxUploadBytes, err := parseSize(keys[i].MaxUploadBytesPerDay)
+		if err != nil {
+			return fmt.Errorf("invalid MaxUploadBytesPerDay for API key %q: %s", keys[i].Name, err)
+		}
+		keys[i].maxUploadBytesPerDay = maxUploadBytes
+	}
+
+	apiKeys = keys
+	return nil
+}
+
+// Middleware rejecting requests that do not have an API key with the given scope
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if len(apiKeys) == 0 {
+				return next(c)
+			}
+
+			key := findAPIKey(requestAPIKeySecret(c))
+			if key == nil {
+				return c.String(http.StatusUnauthorized, "Missing or invalid API key")
+			}
+			if !key.hasScope(scope) {
+				return c.String(http.StatusForbidden, "API key does not have the '"+scope+"' scope")
+			}
+
+			c.Set(apiKeyContextKey, key)
+			return next(c)
+		}
+	}
+}
+
+// Returns the API key the request was authenticated with, or nil if authentication is disabled
+func requestAPIKey(c echo.Context) *APIKey {
+	key, _ := c.Get(apiKeyContextKey).(*APIKey)
+	return key
+}
+
+// Name of the API key the request was authenticated with, or an empty string if authentication is disabled
+func requestAPIKeyName(c echo.Context) string {
+	if key := requestAPIKey(c); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+// Whether the request is allowed to see and modify the jobs created by the given key
+func canAccessJob(c echo.Context, jobAPIKey string) bool {
+	key := requestAPIKey(c)
+	return key == nil || key.hasScope(ScopeAdmin) || key.Name == jobAPIKey
+}
+
+// Whether the key has been granted the scope, admin keys have every scope
+func (key *APIKey) hasScope(scope string) bool {
+	for _, keyScope := range key.Scopes {
+		if keyScope == scope || keyScope == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Private Functions
+
+// Whether the secret is a placeholder copied from an example rather than a real secret
+func isPlaceholderSecret(secret string) bool {
+	for _, placeholder := range placeholderSecrets {
+		if strings.EqualFold(strings.TrimSpace(secret), placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the secret from the `X-API-Key` header or a bearer token in the `Authorization` header
+func requestAPIKeySecret(c echo.Context) string {
+	if secret := c.Request().Header.Get("X-API-Key"); secret != "" {
+		return secret
+	}
+
+	authorization := c.Request().Header.Get(echo.HeaderAuthorization)
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	return ""
+}
+
+// Finds the configured key with the given name
+func findAPIKeyByName(name string) *APIKey {
+	if name == "" {
+		return nil
+	}
+
+	for i := range apiKeys {
+		if apiKeys[i].Name == name {
+			return &apiKeys[i]
+		}
+	}
+	return nil
+}
+
+// Finds the configured key with the given secret
+func findAPIKey(secret string) *APIKey {
+	if secret == "" {
+		return nil
+	}
+
+	for i := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(apiKeys[i].Key), []byte(secret)) == 1 {
+			return &apiKeys[i]
+		}
+	}
+	return nil
+}
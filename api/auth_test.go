@@ -0,0 +1,54 @@
+package api
+
+import "testing"
+
+// Configures the given API keys for the rest of the test
+func setAPIKeys(t *testing.T, keys ...APIKey) {
+	previous := apiKeys
+	apiKeys = keys
+	t.Cleanup(func() { apiKeys = previous })
+}
+
+func TestIsPlaceholderSecret(t *testing.T) {
+	secrets := map[string]bool{
+		"change-me":                        true,
+		"CHANGE-ME":                        true,
+		"  changeme\n":                     true,
+		"change-me-too":                    true,
+		"Password":                         true,
+		"example":                          true,
+		"change-me-please":                 false,
+		"3f9c1a7e0b5d4e2a8c6f1b9d0e7a5c3f": false,
+		"":                                 false,
+	}
+
+	for secret, want := range secrets {
+		if got := isPlaceholderSecret(secret); got != want {
+			t.Errorf("isPlaceholderSecret(%q) = %v, want %v", secret, got, want)
+		}
+	}
+}
+
+func TestFindAPIKey(t *testing.T) {
+	setAPIKeys(t,
+		APIKey{Name: "backend", Key: "3f9c1a7e0b5d4e2a8c6f1b9d0e7a5c3f", Scopes: []string{ScopeUpload}},
+		APIKey{Name: "dashboard", Key: "a8c6f1b9d0e7a5c33f9c1a7e0b5d4e2a", Scopes: []string{ScopeStatus}},
+	)
+
+	if key := findAPIKey("a8c6f1b9d0e7a5c33f9c1a7e0b5d4e2a"); key == nil || key.Name != "dashboard" {
+		t.Errorf("findAPIKey() = %v, want the dashboard key", key)
+	}
+
+	// Only the whole secret matches
+	for _, secret := range []string{"", "3f9c1a7e0b5d4e2a", "3f9c1a7e0b5d4e2a8c6f1b9d0e7a5c3f0", "3F9C1A7E0B5D4E2A8C6F1B9D0E7A5C3F"} {
+		if key := findAPIKey(secret); key != nil {
+			t.Errorf("findAPIKey(%q) = %s, want no key", secret, key.Name)
+		}
+	}
+
+	// A key configured with an empty secret never matches a request without one
+	setAPIKeys(t, APIKey{Name: "unset"})
+	if key := findAPIKey(""); key != nil {
+		t.Errorf("findAPIKey(\"\") = %s, want no key", key.Name)
+	}
+}
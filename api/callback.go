@@ -0,0 +1,58 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Body POSTed to a job's callback URL when it finishes
+type VideoCallbackPayload struct {
+	ID string `json:"id"`
+	VideoEncodingStatusResponse
+}
+
+// Timeout for delivering a callback
+const callbackTimeout = 30 * time.Second
+
+// POSTs the result of the finished job to its callback URL, if it has one
+func notifyVideoCallback(videoUUID string) {
+	EncodingVideos.mutex.Lock()
+	video, ok := EncodingVideos.Videos[videoUUID]
+	EncodingVideos.mutex.Unlock()
+
+	if !ok || video.CallbackURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(videoResult(videoUUID, video))
+	if err != nil {
+		log.Error().Msgf("Failed encoding callback for %s: %s", videoUUID, err)
+		return
+	}
+
+	client := http.Client{Timeout: callbackTimeout}
+	res, err := client.Post(video.CallbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error().Msgf("Failed sending callback for %s: %s", videoUUID, err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		log.Error().Msgf("Callback for %s was rejected with status %d", videoUUID, res.StatusCode)
+	}
+}
+
+// Private Functions
+
+// Result of a finished job, as sent to its callback URL
+func videoResult(videoUUID string, video EncodingVideo) VideoCallbackPayload {
+	if video.Error != nil {
+		return VideoCallbackPayload{ID: videoUUID, VideoEncodingStatusResponse: VideoEncodingStatusResponse{State: video.State, Finished: true, SourceCID: video.SourceCID, Error: video.Error.Error()}}
+	}
+	return VideoCallbackPayload{ID: videoUUID, VideoEncodingStatusResponse: VideoEncodingStatusResponse{State: video.State, Finished: true, CID: video.CID, Length: video.Length, Loudness: video.Loudness, Ladder: video.Ladder, Quality: video.Quality, Metadata: video.Metadata, Details: video.Details, SourceCID: video.SourceCID}}
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// A part of the source encoded by its own ffmpeg process, from one keyframe to the next chunk's
+type encodeChunk struct {
+	start float64
+	// End of the chunk in seconds, 0 for the end of the video
+	end float64
+}
+
+// Progress of the chunks of a video being encoded in parallel, combined into the video's entry in the encoding map
+type chunkProgress struct {
+	mutex     sync.Mutex
+	videoUUID string
+	chunks    []EncodeProgress
+	finished  []bool
+}
+
+// Folders the chunks are encoded into inside the video folder, before they are stitched together
+const chunkFolderPrefix = "chunk_"
+
+// Splits the video into chunks at keyframes, each about `Videos.ParallelChunkLength` long.
+// Returns nil if chunked encoding is disabled or the video is too short to be worth splitting.
+func planEncodeChunks(ctx context.Context, videoFile string, videoStream *StreamMetadata, duration float64) ([]encodeChunk, error) {
+	chunkLength := viper.GetDuration("Videos.ParallelChunkLength").Seconds()
+	if chunkLength <= 0 || duration < chunkLength*2 {
+		return nil, nil
+	}
+
+	keyframes, err := probeKeyframes(ctx, videoFile, videoStream.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each chunk starts at the first keyframe after its share of the video, so it can be seeked to without decoding the chunk before it.
+	// A short last chunk is merged into the one before it.
+	chunks := []encodeChunk{{start: 0}}
+	next := 0
+	for i := 1; float64(i)*chunkLength < duration-chunkLength/2; i++ {
+		for next < len(keyframes) && keyframes[next] < float64(i)*chunkLength {
+			next++
+		}
+		if next == len(keyframes) || keyframes[next] >= duration-chunkLength/2 {
+			break
+		}
+		if keyframes[next] <= chunks[len(chunks)-1].start {
+			continue
+		}
+
+		chunks[len(chunks)-1].end = keyframes[next]
+		chunks = append(chunks, encodeChunk{start: keyframes[next]})
+	}
+
+	return chunks, nil
+}
+
+// Encodes the chunks of the video in parallel, each to its own folder, then stitches their playlists together in the video folder.
+// Every chunk is encoded with the same ffmpeg command as a whole video, with its timestamps offset to where it starts in the video,
+// so the segments of the chunks play back as one stream.
+func transcodeChunksToHLS(ctx context.Context, videoFile, videoFolder, videoUUID string, profile EncodingProfile, metadata *VideoMetadata, renditions []hlsRendition, outputRange string, loudness *LoudnessMeasurement, chunks []encodeChunk) error {
+	log.Info().Msgf("Converting %s to HLS in %d chunks...\n", videoFile, len(chunks))
+
+	chunkFolders := []string{}
+	for i := range chunks {
+		chunkFolder := path.Join(videoFolder, fmt.Sprintf("%s%03d", chunkFolderPrefix, i))
+		if err := os.MkdirAll(chunkFolder, 0755); err != nil {
+			return err
+		}
+		chunkFolders = append(chunkFolders, chunkFolder)
+	}
+	defer func() {
+		for _, chunkFolder := range chunkFolders {
+			os.RemoveAll(chunkFolder)
+		}
+	}()
+
+	// The first chunk to fail stops the others
+	chunksCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := &chunkProgress{videoUUID: videoUUID, chunks: make([]EncodeProgress, len(chunks)), finished: make([]bool, len(chunks))}
+	queue := make(chan int, len(chunks))
+	for i := range chunks {
+		queue <- i
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var chunkErr error
+	for worker := 0; worker < parallelChunks(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if chunksCtx.Err() != nil {
+					return
+				}
+				if err := transcodeChunk(chunksCtx, videoFile, chunkFolders[i], profile, metadata, renditions, outputRange, loudness, chunks[i], func(block map[string]string) { progress.update(i, block) }); err != nil {
+					errOnce.Do(func() {
+						chunkErr = fmt.Errorf("chunk %d at %.3fs: %s", i, chunks[i].start, err)
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Report the job being cancelled rather than the chunk it interrupted
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if chunkErr != nil {
+		return chunkErr
+	}
+	finishEncodeProgress(videoUUID)
+
+	return stitchChunkPlaylists(videoFolder, chunkFolders, renditions)
+}
+
+// Private Functions
+
+// Returns the times in seconds of the keyframes of the video stream from the start of the video, in order
+func probeKeyframes(ctx context.Context, videoFile string, streamIndex int) ([]float64, error) {
+	// Only the packets are read, which is much faster than decoding the frames
+	cmd := exec.CommandContext(ctx, viper.GetString("ffmpeg.ffprobeDir"), "-v", "error", "-select_streams", strconv.Itoa(streamIndex), "-show_entries", "packet=pts_time,flags:format=start_time", "-of", "csv=p=0", videoFile)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// Packets are printed as "<pts_time>,<flags>", and the start time of the video on a line of its own
+	keyframes := []float64{}
+	startTime := 0.0
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		time, err := strconv.ParseFloat(fields[0], 64)
+		switch {
+		case err != nil:
+		case len(fields) == 1:
+			startTime = time
+		case strings.HasPrefix(fields[1], "K"):
+			keyframes = append(keyframes, time)
+		}
+	}
+
+	// ffmpeg seeks from the start of the video, and packets are listed in decoding order, which is not always presentation order
+	for i := range keyframes {
+		keyframes[i] -= startTime
+	}
+	sort.Float64s(keyframes)
+	return keyframes, nil
+}
+
+// Encodes one chunk of the video into its folder
+func transcodeChunk(ctx context.Context, videoFile, chunkFolder string, profile EncodingProfile, metadata *VideoMetadata, renditions []hlsRendition, outputRange string, loudness *LoudnessMeasurement, chunk encodeChunk, onProgress func(block map[string]string)) error {
+	ffmpegArgs, err := buildFfmpegCommand(videoFile, chunkFolder, profile, metadata, renditions, outputRange, loudness)
+	if err != nil {
+		return errors.New("Failed to build ffmpeg command: " + err.Error())
+	}
+
+	// Seek the input to the chunk, and offset the output so its timestamps continue from the chunk before it
+	inputArgs := []string{"-ss", fmt.Sprintf("%.6f", chunk.start)}
+	if chunk.end > 0 {
+		inputArgs = append(inputArgs, "-to", fmt.Sprintf("%.6f", chunk.end))
+	}
+	output := ffmpegArgs[len(ffmpegArgs)-1]
+	ffmpegArgs = append(append(inputArgs, ffmpegArgs[:len(ffmpegArgs)-1]...), "-output_ts_offset", fmt.Sprintf("%.6f", chunk.start), output)
+	log.Debug().Msg(strings.Join(ffmpegArgs, " "))
+
+	return runFfmpeg(ctx, ffmpegArgs, func(stdout io.ReadCloser) {
+		readProgressBlocks(stdout, onProgress)
+	})
+}
+
+// Number of chunks encoded at once, from `Videos.ParallelChunks`
+func parallelChunks() int {
+	if parallel := viper.GetInt("Videos.ParallelChunks"); parallel > 0 {
+		return parallel
+	}
+
+	// ffmpeg already uses several cores for each chunk
+	if parallel := runtime.NumCPU() / 4; parallel > 2 {
+		return parallel
+	}
+	return 2
+}
+
+// Updates the video's entry in the encoding map with the progress of one of its chunks
+func (progress *chunkProgress) update(chunk int, block map[string]string) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+
+	progress.chunks[chunk] = parseProgressBlock(block, 0, 0)
+	progress.finished[chunk] = block["progress"] == "end"
+
+	// The chunks together are as far through the video as the sum of their progress, and as fast as the chunks running at once
+	total := EncodeProgress{}
+	for i, chunkProgress := range progress.chunks {
+		total.Frame += chunkProgress.Frame
+		total.OutTime += chunkProgress.OutTime
+		total.Bitrate = math.Max(total.Bitrate, chunkProgress.Bitrate)
+		if !progress.finished[i] {
+			total.FPS += chunkProgress.FPS
+			total.Speed += chunkProgress.Speed
+		}
+	}
+
+	EncodingVideos.update(progress.videoUUID, func(video *EncodingVideo) {
+		if total.Speed > 0 && video.Duration > 0 {
+			total.TimeRemaining = math.Max(video.Duration-total.OutTime, 0) / total.Speed
+		} else if total.FPS > 0 && video.TotalFrames > 0 {
+			total.TimeRemaining = math.Max(float64(video.TotalFrames-total.Frame), 0) / total.FPS
+		}
+		video.Telemetry = total
+		video.CurrentProgress = calculateEncodeProgress(total, video.TotalFrames, video.Duration, video.CurrentProgress)
+	})
+}
+
+// Joins the media playlists of the chunks into one playlist per rendition in the video folder, moving their segments into it.
+// Segments are renumbered in order across the chunks, so the video folder looks the same as one encoded whole.
+// Each chunk after the first starts after a discontinuity, since its audio was encoded on its own and starts with
+// the encoder's priming samples, which would overlap the end of the previous chunk if played back without a reset.
+// For fMP4 renditions, chunks whose init segment differs from the first chunk's also get their own.
+func stitchChunkPlaylists(videoFolder string, chunkFolders []string, renditions []hlsRendition) error {
+	for i, rendition := range renditions {
+		streamName := rendition.streamName(i)
+		playlistName := "stream_" + streamName + ".m3u8"
+
+		header := []string{}
+		body := []string{}
+		targetDuration := 0
+		segment := 0
+		firstInit := ""
+		for chunk, chunkFolder := range chunkFolders {
+			playlist, err := os.ReadFile(path.Join(chunkFolder, playlistName))
+			if err != nil {
+				return err
+			}
+
+			if chunk > 0 {
+				body = append(body, "#EXT-X-DISCONTINUITY")
+			}
+
+			inHeader := true
+			for _, line := range strings.Split(string(playlist), "\n") {
+				line = strings.TrimRight(line, "\r")
+				switch {
+				case line == "" || line == "#EXT-X-ENDLIST":
+				case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+					if duration, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")); err == nil && duration > targetDuration {
+						targetDuration = duration
+					}
+					if chunk == 0 {
+						header = append(header, line)
+					}
+				case strings.HasPrefix(line, "#EXT-X-MAP:"):
+					initName := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-MAP:"))["URI"]
+					stitched, err := stitchChunkInit(videoFolder, chunkFolder, initName, firstInit, chunk)
+					if err != nil {
+						return err
+					}
+					if chunk == 0 {
+						firstInit = stitched
+						header = append(header, line)
+					} else if stitched != firstInit {
+						body = append(body, fmt.Sprintf(`#EXT-X-MAP:URI="%s"`, stitched))
+					}
+				case strings.HasPrefix(line, "#EXTINF:"):
+					inHeader = false
+					body = append(body, line)
+				case strings.HasPrefix(line, "#"):
+					if inHeader {
+						if chunk == 0 {
+							header = append(header, line)
+						}
+					} else {
+						body = append(body, line)
+					}
+				default:
+					// Segment URI
+					name := fmt.Sprintf("stream_%s-data%02d%s", streamName, segment, filepath.Ext(line))
+					if err := os.Rename(path.Join(chunkFolder, line), path.Join(videoFolder, name)); err != nil {
+						return err
+					}
+					body = append(body, name)
+					segment++
+				}
+			}
+		}
+
+		for j, line := range header {
+			if strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+				header[j] = "#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration)
+			}
+		}
+
+		lines := append(append(header, body...), "#EXT-X-ENDLIST")
+		if err := os.WriteFile(path.Join(videoFolder, playlistName), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	// The chunks share the same variants, so any chunk's master playlist describes the stitched video
+	return os.Rename(path.Join(chunkFolders[0], "master.m3u8"), path.Join(videoFolder, "master.m3u8"))
+}
+
+// Moves a chunk's init segment into the video folder, returning the name it is given.
+// Init segments the same as the first chunk's are dropped in favour of the first chunk's.
+func stitchChunkInit(videoFolder, chunkFolder, initName, firstInit string, chunk int) (string, error) {
+	if chunk == 0 {
+		return initName, os.Rename(path.Join(chunkFolder, initName), path.Join(videoFolder, initName))
+	}
+
+	initSegment, err := os.ReadFile(path.Join(chunkFolder, initName))
+	if err != nil {
+		return "", err
+	}
+	firstInitSegment, err := os.ReadFile(path.Join(videoFolder, firstInit))
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(initSegment, firstInitSegment) {
+		return firstInit, nil
+	}
+
+	name := strings.TrimSuffix(initName, filepath.Ext(initName)) + strconv.Itoa(chunk) + filepath.Ext(initName)
+	return name, os.WriteFile(path.Join(videoFolder, name), initSegment, 0644)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestStitchChunkPlaylists(t *testing.T) {
+	tests := []struct {
+		name       string
+		renditions []hlsRendition
+		// Files written to each chunk's folder, by name
+		chunks []map[string]string
+		// Files expected in the video folder, by name
+		want map[string]string
+	}{
+		{
+			name:       "MPEG-TS segments are renumbered across chunks",
+			renditions: []hlsRendition{{height: 360}},
+			chunks: []map[string]string{
+				{
+					"master.m3u8":        "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nstream_0.m3u8\n",
+					"stream_0.m3u8":      "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:6.000000,\nstream_0-data00.ts\n#EXTINF:4.000000,\nstream_0-data01.ts\n#EXT-X-ENDLIST\n",
+					"stream_0-data00.ts": "chunk 0 segment 0",
+					"stream_0-data01.ts": "chunk 0 segment 1",
+				},
+				{
+					"master.m3u8":        "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nstream_0.m3u8\n",
+					"stream_0.m3u8":      "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:7\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:6.500000,\nstream_0-data00.ts\n#EXT-X-ENDLIST\n",
+					"stream_0-data00.ts": "chunk 1 segment 0",
+				},
+			},
+			want: map[string]string{
+				"master.m3u8":        "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nstream_0.m3u8\n",
+				"stream_0.m3u8":      "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:7\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:6.000000,\nstream_0-data00.ts\n#EXTINF:4.000000,\nstream_0-data01.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:6.500000,\nstream_0-data02.ts\n#EXT-X-ENDLIST\n",
+				"stream_0-data00.ts": "chunk 0 segment 0",
+				"stream_0-data01.ts": "chunk 0 segment 1",
+				"stream_0-data02.ts": "chunk 1 segment 0",
+			},
+		},
+		{
+			name:       "identical fMP4 init segments are shared",
+			renditions: []hlsRendition{{height: 1080, name: "hevc-1080"}},
+			chunks: []map[string]string{
+				{
+					"master.m3u8":                 "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-STREAM-INF:BANDWIDTH=1600000\nstream_hevc-1080.m3u8\n",
+					"stream_hevc-1080.m3u8":       "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"stream_hevc-1080_init.mp4\"\n#EXTINF:6.000000,\nstream_hevc-1080-data00.m4s\n#EXT-X-ENDLIST\n",
+					"stream_hevc-1080_init.mp4":   "init",
+					"stream_hevc-1080-data00.m4s": "chunk 0 segment 0",
+				},
+				{
+					"master.m3u8":                 "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-STREAM-INF:BANDWIDTH=1600000\nstream_hevc-1080.m3u8\n",
+					"stream_hevc-1080.m3u8":       "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"stream_hevc-1080_init.mp4\"\n#EXTINF:5.000000,\nstream_hevc-1080-data00.m4s\n#EXT-X-ENDLIST\n",
+					"stream_hevc-1080_init.mp4":   "init",
+					"stream_hevc-1080-data00.m4s": "chunk 1 segment 0",
+				},
+			},
+			want: map[string]string{
+				"stream_hevc-1080.m3u8":       "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"stream_hevc-1080_init.mp4\"\n#EXTINF:6.000000,\nstream_hevc-1080-data00.m4s\n#EXT-X-DISCONTINUITY\n#EXTINF:5.000000,\nstream_hevc-1080-data01.m4s\n#EXT-X-ENDLIST\n",
+				"stream_hevc-1080_init.mp4":   "init",
+				"stream_hevc-1080-data00.m4s": "chunk 0 segment 0",
+				"stream_hevc-1080-data01.m4s": "chunk 1 segment 0",
+			},
+		},
+		{
+			name:       "differing fMP4 init segments are kept after the discontinuity",
+			renditions: []hlsRendition{{height: 1080, name: "av1-1080"}},
+			chunks: []map[string]string{
+				{
+					"master.m3u8":                "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-STREAM-INF:BANDWIDTH=1200000\nstream_av1-1080.m3u8\n",
+					"stream_av1-1080.m3u8":       "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"stream_av1-1080_init.mp4\"\n#EXTINF:6.000000,\nstream_av1-1080-data00.m4s\n#EXT-X-ENDLIST\n",
+					"stream_av1-1080_init.mp4":   "init 0",
+					"stream_av1-1080-data00.m4s": "chunk 0 segment 0",
+				},
+				{
+					"master.m3u8":                "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-STREAM-INF:BANDWIDTH=1200000\nstream_av1-1080.m3u8\n",
+					"stream_av1-1080.m3u8":       "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"stream_av1-1080_init.mp4\"\n#EXTINF:6.000000,\nstream_av1-1080-data00.m4s\n#EXT-X-ENDLIST\n",
+					"stream_av1-1080_init.mp4":   "init 1",
+					"stream_av1-1080-data00.m4s": "chunk 1 segment 0",
+				},
+			},
+			want: map[string]string{
+				"stream_av1-1080.m3u8":       "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"stream_av1-1080_init.mp4\"\n#EXTINF:6.000000,\nstream_av1-1080-data00.m4s\n#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"stream_av1-1080_init1.mp4\"\n#EXTINF:6.000000,\nstream_av1-1080-data01.m4s\n#EXT-X-ENDLIST\n",
+				"stream_av1-1080_init.mp4":   "init 0",
+				"stream_av1-1080_init1.mp4":  "init 1",
+				"stream_av1-1080-data00.m4s": "chunk 0 segment 0",
+				"stream_av1-1080-data01.m4s": "chunk 1 segment 0",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			videoFolder := t.TempDir()
+			chunkFolders := []string{}
+			for i, files := range test.chunks {
+				chunkFolder := path.Join(videoFolder, "chunk"+strconv.Itoa(i))
+				if err := os.Mkdir(chunkFolder, 0755); err != nil {
+					t.Fatal(err)
+				}
+				for name, content := range files {
+					writeTestFile(t, path.Join(chunkFolder, name), content)
+				}
+				chunkFolders = append(chunkFolders, chunkFolder)
+			}
+
+			if err := stitchChunkPlaylists(videoFolder, chunkFolders, test.renditions); err != nil {
+				t.Fatalf("stitchChunkPlaylists() failed: %s", err)
+			}
+			for name, want := range test.want {
+				if got := readTestFile(t, path.Join(videoFolder, name)); got != want {
+					t.Errorf("%s is\n%s\nwant\n%s", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Disk usage of the temp video storage folder and the space reserved by jobs, reported in the node status
+type DiskStatus struct {
+	Folder     string `json:"folder"`
+	TotalBytes uint64 `json:"totalBytes"`
+	UsedBytes  uint64 `json:"usedBytes"`
+	FreeBytes  uint64 `json:"freeBytes"`
+	// Fraction of the disk jobs are allowed to fill
+	HighWaterMark float64 `json:"highWaterMark"`
+	// Bytes reserved by jobs that have not been written yet
+	ReservedBytes int64             `json:"reservedBytes"`
+	Reservations  []DiskReservation `json:"reservations"`
+}
+
+// Space reserved on disk by a job
+type DiskReservation struct {
+	ID string `json:"id"`
+	// Bytes the job is expected to use in total
+	Bytes int64 `json:"bytes"`
+	// Bytes the job is expected to use that have not been written yet
+	OutstandingBytes int64 `json:"outstandingBytes"`
+}
+
+// Defaults used when disk admission is not configured
+const (
+	defaultDiskHighWaterMark = 0.9
+	diskSpacePollInterval    = 5 * time.Second
+)
+
+// What to do with a job that does not fit on disk, from `Videos.DiskFullAction`
+const (
+	DiskFullReject = "reject"
+	DiskFullDelay  = "delay"
+)
+
+// Assumed bitrate of each rendition's audio, since the audio bitrate is left to the encoder
+const estimatedAudioBitRate = 128000
+
+// Space reserved by each job, keyed by job ID.
+// Each job reserves the expected size of the files or folders it writes, keyed by path,
+// so the outstanding space is the reservation less what has already been written to that path.
+var diskReservations = struct {
+	mutex sync.Mutex
+	jobs  map[string]map[string]int64
+}{jobs: map[string]map[string]int64{}}
+
+// Reserves the space a job expects to write to the path, if it fits below the high-water mark
+func reserveDisk(videoUUID, reservedPath string, bytes int64) *videoRejection {
+	diskReservations.mutex.Lock()
+	defer diskReservations.mutex.Unlock()
+
+	status, err := diskStatusLocked()
+	if err != nil {
+		return newVideoRejection(http.StatusInsufficientStorage, RejectInsufficientStorage, "failed checking free disk space: %s", err)
+	}
+
+	// Only what has not been written to the path yet needs room, which is all of it unless a resumed job's file is already on disk
+	if needed, available := bytes-writtenBytes(reservedPath), availableDisk(status); needed > available {
+		return newVideoRejection(http.StatusInsufficientStorage, RejectInsufficientStorage, "video needs about %d bytes of disk space, only %d bytes are available", needed, available)
+	}
+
+	if diskReservations.jobs[videoUUID] == nil {
+		diskReservations.jobs[videoUUID] = map[string]int64{}
+	}
+	diskReservations.jobs[videoUUID][reservedPath] = bytes
+	return nil
+}
+
+// Waits until the space a job expects to write to the path can be reserved, or ctx is cancelled
+func waitForDisk(ctx context.Context, videoUUID, reservedPath string, bytes int64) error {
+	for reserveDisk(videoUUID, reservedPath, bytes) != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(diskSpacePollInterval):
+		}
+	}
+	return nil
+}
+
+// Whether a job that does not fit on disk now should wait for other jobs to free space.
+// Jobs are only delayed if delaying is configured and other jobs hold reservations, otherwise space may never be freed.
+func shouldDelayForDisk(videoUUID string) bool {
+	if viper.GetString("Videos.DiskFullAction") != DiskFullDelay {
+		return false
+	}
+
+	diskReservations.mutex.Lock()
+	defer diskReservations.mutex.Unlock()
+
+	for id := range diskReservations.jobs {
+		if id != videoUUID {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the job has reserved space for the path
+func diskReserved(videoUUID, reservedPath string) bool {
+	diskReservations.mutex.Lock()
+	defer diskReservations.mutex.Unlock()
+
+	_, ok := diskReservations.jobs[videoUUID][reservedPath]
+	return ok
+}
+
+// Releases the space a job reserved for the path, once the path has been removed
+func releaseDiskPath(videoUUID, reservedPath string) {
+	diskReservations.mutex.Lock()
+	defer diskReservations.mutex.Unlock()
+
+	delete(diskReservations.jobs[videoUUID], reservedPath)
+	if len(diskReservations.jobs[videoUUID]) == 0 {
+		delete(diskReservations.jobs, videoUUID)
+	}
+}
+
+// Releases all the space reserved by a job
+func releaseDisk(videoUUID string) {
+	diskReservations.mutex.Lock()
+	defer diskReservations.mutex.Unlock()
+
+	delete(diskReservations.jobs, videoUUID)
+}
+
+// Returns the disk usage of the temp video storage folder and the reservations of every job
+func getDiskStatus() (DiskStatus, error) {
+	diskReservations.mutex.Lock()
+	defer diskReservations.mutex.Unlock()
+
+	return diskStatusLocked()
+}
+
+// Estimates the size of the HLS renditions of a video, from the bitrates of the ladder and its length
+func estimateHLSSize(metadata *VideoMetadata, profile EncodingProfile) int64 {
+	size := estimateRenditionsSize(ladderRenditions(firstVideoStream(metadata), profile), metadata.Duration)
+
+	// The ladder is not analyzed until the job runs, so allow for the highest bitrates it can choose
+	if profile.AdaptiveLadder {
+		size = int64(float64(size) * adaptiveMaxBitRateFactor)
+	}
+	return size
+}
+
+// Estimates the size of the given renditions of a video from their bitrates and the length of the video
+func estimateRenditionsSize(renditions []hlsRendition, duration float64) int64 {
+	var bitRate int64
+	for _, rendition := range renditions {
+		bitRate += parseBitRate(rendition.bitRate) + estimatedAudioBitRate
+	}
+
+	// Allow for bitrate overshoot and container overhead
+	return int64(float64(bitRate) / 8 * duration * 1.2)
+}
+
+// Private Functions
+
+// `diskReservations.mutex` must be held.
+func diskStatusLocked() (DiskStatus, error) {
+	status := DiskStatus{Folder: viper.GetString("Videos.TempVideoStorageFolder"), HighWaterMark: diskHighWaterMark(), Reservations: []DiskReservation{}}
+
+	var err error
+	status.TotalBytes, status.UsedBytes, status.FreeBytes, err = diskSpace(status.Folder)
+	if err != nil {
+		return status, err
+	}
+
+	for id, paths := range diskReservations.jobs {
+		reservation := DiskReservation{ID: id}
+		for reservedPath, bytes := range paths {
+			reservation.Bytes += bytes
+			if outstanding := bytes - writtenBytes(reservedPath); outstanding > 0 {
+				reservation.OutstandingBytes += outstanding
+			}
+		}
+		status.ReservedBytes += reservation.OutstandingBytes
+		status.Reservations = append(status.Reservations, reservation)
+	}
+
+	sort.Slice(status.Reservations, func(i, j int) bool { return status.Reservations[i].ID < status.Reservations[j].ID })
+	return status, nil
+}
+
+// Bytes jobs can still reserve. Jobs can fill the disk up to the high-water mark, as long as the space is free for dapper to write to.
+func availableDisk(status DiskStatus) int64 {
+	available := int64(float64(status.TotalBytes)*status.HighWaterMark) - int64(status.UsedBytes) - status.ReservedBytes
+	if free := int64(status.FreeBytes) - status.ReservedBytes; free < available {
+		available = free
+	}
+	return available
+}
+
+// Fraction of the disk jobs are allowed to fill, from `Videos.DiskHighWaterMark`
+func diskHighWaterMark() float64 {
+	mark := viper.GetFloat64("Videos.DiskHighWaterMark")
+	if mark <= 0 || mark > 1 {
+		return defaultDiskHighWaterMark
+	}
+	return mark
+}
+
+// Bytes written so far to a reserved file or folder
+func writtenBytes(reservedPath string) int64 {
+	info, err := os.Stat(reservedPath)
+	if err != nil {
+		return 0
+	}
+	if info.IsDir() {
+		return folderSize(reservedPath)
+	}
+	return info.Size()
+}
+
+// Parses an ffmpeg bitrate such as "500k" or "5M" into bits per second
+func parseBitRate(bitRate string) int64 {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(bitRate, "k"):
+		multiplier = 1000
+	case strings.HasSuffix(bitRate, "M"):
+		multiplier = 1000000
+	}
+
+	value, _ := strconv.ParseFloat(strings.TrimRight(bitRate, "kM"), 64)
+	return int64(value * float64(multiplier))
+}
@@ -0,0 +1,50 @@
+package api
+
+import "testing"
+
+func TestAvailableDisk(t *testing.T) {
+	tests := []struct {
+		name   string
+		status DiskStatus
+		want   int64
+	}{
+		{
+			name:   "empty disk fills to the high-water mark",
+			status: DiskStatus{TotalBytes: 1000, FreeBytes: 1000, HighWaterMark: 0.9},
+			want:   900,
+		},
+		{
+			name:   "used space counts against the mark",
+			status: DiskStatus{TotalBytes: 1000, UsedBytes: 600, FreeBytes: 400, HighWaterMark: 0.9},
+			want:   300,
+		},
+		{
+			name:   "outstanding reservations count against the mark",
+			status: DiskStatus{TotalBytes: 1000, UsedBytes: 600, FreeBytes: 400, HighWaterMark: 0.9, ReservedBytes: 250},
+			want:   50,
+		},
+		{
+			name:   "blocks reserved for root are not free",
+			status: DiskStatus{TotalBytes: 1000, UsedBytes: 200, FreeBytes: 500, HighWaterMark: 0.9},
+			want:   500,
+		},
+		{
+			name:   "reservations count against the free space too",
+			status: DiskStatus{TotalBytes: 1000, UsedBytes: 200, FreeBytes: 500, HighWaterMark: 0.9, ReservedBytes: 100},
+			want:   400,
+		},
+		{
+			name:   "over the mark",
+			status: DiskStatus{TotalBytes: 1000, UsedBytes: 950, FreeBytes: 50, HighWaterMark: 0.9},
+			want:   -50,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := availableDisk(test.status); got != test.want {
+				t.Errorf("availableDisk(%+v) = %d, want %d", test.status, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package api
+
+import "syscall"
+
+// Size of the filesystem holding the folder, the bytes used on it, and the bytes free on it for unprivileged users.
+// Blocks reserved for root are neither used nor free, so used and free do not add up to the total.
+func diskSpace(folder string) (total, used, free uint64, err error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(folder, &stat); err != nil {
+		return 0, 0, 0, err
+	}
+	return uint64(stat.Blocks) * uint64(stat.Bsize), uint64(stat.Blocks-stat.Bfree) * uint64(stat.Bsize), uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
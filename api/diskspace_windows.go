@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package api
+
+import "golang.org/x/sys/windows"
+
+// Size of the volume holding the folder, the bytes used on it, and the bytes free on it for the current user
+func diskSpace(folder string) (total, used, free uint64, err error) {
+	folderPtr, err := windows.UTF16PtrFromString(folder)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(folderPtr, &free, &total, &totalFree); err != nil {
+		return 0, 0, 0, err
+	}
+	return total, total - totalFree, free, nil
+}
@@ -2,16 +2,17 @@ package api
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -25,26 +26,67 @@ type EncodingVideosList struct {
 
 // Information about a video currently being encoded/processed
 type EncodingVideo struct {
+	State           string
 	TotalFrames     int64
+	Duration        float64
 	CurrentProgress int64
+	Telemetry       EncodeProgress
 	CID             string
 	Length          int
-	Error           error
+	Loudness        *LoudnessMeasurement
+	Metadata        *VideoMetadata
+	Details         *VideoDetails
+	// Ladder chosen by the adaptive analysis pass, nil for the standard ladder
+	Ladder []LadderRung
+	// Scores of the renditions, if the profile measures them
+	Quality []RenditionQuality
+	// CID the video was imported from, empty for uploads
+	SourceCID string
+	Error     error
+	// Name of the API key that created the job
+	APIKey string
+	// URL the result is POSTed to when the job finishes
+	CallbackURL string
+	CreatedAt   time.Time
+	// Cancels the job's context, stopping ffmpeg and pinning
+	cancel context.CancelFunc
+	// Scratch file and profile the video is transcoded from, saved to resume the job after a restart
+	source  string
+	profile EncodingProfile
+	// Whether the job adds renditions to the video at SourceCID rather than transcoding a new video
+	addRenditions bool
+	// CID the source is fetched from when it is not on disk yet
+	fetchCID string
+	// Transcode minutes held against the key's monthly limit while the job runs
+	reservedMinutes float64
 }
 
+// Values of the `VIDEO-RANGE` attribute in HLS master playlists
+const (
+	VideoRangeSDR = "SDR"
+	VideoRangePQ  = "PQ"
+	VideoRangeHLG = "HLG"
+)
+
+// Filter chain converting HDR (PQ or HLG) video to SDR BT.709.
+// Requires ffmpeg to be built with libzimg for the zscale filter.
+const toneMapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
 // HLSChunkLength - Size of HLS pieces in seconds
 const HLSChunkLength = 10
 
 // Standard video resolutions for transcoding videos
 // These are the widths associated with the standard 16:9 resolutions
-var standardVideoWidths = []int64{426, 640, 854, 1280, 1920}
-var standardVideoHeights = []int64{240, 360, 480, 720, 1080}
+var standardVideoWidths = []int64{426, 640, 854, 1280, 1920, 2560, 3840}
+var standardVideoHeights = []int64{240, 360, 480, 720, 1080, 1440, 2160}
 var resolutionBitRates = map[int]string{
 	240:  "500k",
 	360:  "1M",
 	480:  "2M",
 	720:  "3M",
 	1080: "5M",
+	1440: "8M",
+	2160: "16M",
 }
 var resolutionBufferSizes = map[int]string{
 	240:  "1M",
@@ -52,111 +94,168 @@ var resolutionBufferSizes = map[int]string{
 	480:  "4M",
 	720:  "6M",
 	1080: "10M",
+	1440: "16M",
+	2160: "32M",
+}
+
+// States of a video job
+const (
+	// Imported videos are fetched from IPFS before they are queued
+	JobFetching  = "fetching"
+	JobQueued    = "queued"
+	JobAnalyzing = "analyzing"
+	JobEncoding  = "encoding"
+	// Renditions are scored against the source when the profile asks for quality metrics
+	JobMeasuring = "measuring"
+	JobPinning   = "pinning"
+	JobFinished  = "finished"
+	JobFailed    = "failed"
+)
+
+// A rendition of the HLS ladder
+type hlsRendition struct {
+	width      int64
+	height     int64
+	bitRate    string
+	bufferSize string
+	// Files of the rendition are named `stream_<name>`, or `stream_<index>` if it has no name
+	name string
 }
 
 // Videos Currently being processed
 var EncodingVideos EncodingVideosList
 
+// Applies the given changes to a video in the map.
+// Nothing is changed if the video has been removed from the map.
+func (list *EncodingVideosList) update(videoUUID string, update func(video *EncodingVideo)) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	video, ok := list.Videos[videoUUID]
+	if !ok {
+		return
+	}
+	update(&video)
+	list.Videos[videoUUID] = video
+}
+
 // Functions used outside of this file
 
-// Uses `ffprobe` to find the length of the video in seconds (ceilinged to next largest int)
-func getVideoLength(videoFile string) (videoLength int, err error) {
-	cmd := exec.Command(viper.GetString("ffmpeg.ffprobeDir"), "-i", videoFile, "-show_entries", "format=duration", "-v", "quiet", "-of", `csv=p=0`)
-	out, err := cmd.CombinedOutput()
+// Converts the given video to HLS chunks of the given renditions and places them in a folder named with the video's UUID
+func convertToHLS(ctx context.Context, videoFile, videoUUID string, profile EncodingProfile, metadata *VideoMetadata, renditions []hlsRendition, loudness *LoudnessMeasurement) (videoFolder string, err error) {
+	// Create folder to store HLS video in
+	videoFolder = path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
+	err = os.Mkdir(videoFolder, 0755)
 	if err != nil {
-		return 0, errors.New(string(out) + " | " + err.Error())
+		return "", err
 	}
 
-	videoLengthFloat, err := strconv.ParseFloat(string(out[:len(out)-1]), 64)
+	err = transcodeRenditionsToHLS(ctx, videoFile, videoFolder, videoUUID, profile, metadata, renditions, loudness)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 
-	videoLength = int(math.Ceil(videoLengthFloat))
-
-	return videoLength, nil
+	return videoFolder, nil
 }
 
-// Gets the number of frames in the given video
-func getVideoFrames(videoFile string, videoLength int) (int64, error) {
-	cmd := exec.Command(viper.GetString("ffmpeg.ffprobeDir"), "-i", videoFile, "-show_entries", "stream=r_frame_rate", "-v", "error", "-of", `default=nokey=1:noprint_wrappers=1`, "-select_streams", "v:0")
-	out, err := cmd.CombinedOutput()
+// Transcodes the given video to the given renditions in an existing folder, with a master playlist of only those renditions.
+// Progress is written to the video's entry in the encoding map, if it has one.
+func transcodeRenditionsToHLS(ctx context.Context, videoFile, videoFolder, videoUUID string, profile EncodingProfile, metadata *VideoMetadata, renditions []hlsRendition, loudness *LoudnessMeasurement) error {
+	videoStream := firstVideoStream(metadata)
+	if videoStream == nil {
+		return errors.New("no video stream found")
+	}
+
+	// Determine whether the source is HDR to know if it needs to be tone-mapped
+	outputRange := profile.outputRange(videoStream)
+
+	// Long videos are split into chunks that are encoded in parallel, if the node is configured to
+	chunks, err := planEncodeChunks(ctx, videoFile, videoStream, metadata.Duration)
 	if err != nil {
-		return 0, errors.New(string(out) + " | " + err.Error())
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Warn().Msgf("Unable to split %s into chunks, encoding it whole: %s", videoFile, err)
+		chunks = nil
 	}
 
-	output := string(out)
-	videoFPS, err := strconv.ParseInt(strings.Split(output, "/")[0], 10, 64)
+	startTime := time.Now()
+	if len(chunks) > 1 {
+		err = transcodeChunksToHLS(ctx, videoFile, videoFolder, videoUUID, profile, metadata, renditions, outputRange, loudness, chunks)
+	} else {
+		err = transcodeWholeToHLS(ctx, videoFile, videoFolder, videoUUID, profile, metadata, renditions, outputRange, loudness)
+	}
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return int64(videoLength) * videoFPS, nil
+	observeTranscode(profile.Codec, metadata.Duration, time.Since(startTime).Seconds())
+
+	// ffmpeg does not write the dynamic range of the renditions into the master playlist
+	return tagMasterPlaylistVideoRange(path.Join(videoFolder, "master.m3u8"), outputRange)
 }
 
-// Converts the given video to HLS chunks and places them in a folder named with the video's UUID
-func convertToHLS(videoFile, videoUUID string) (videoFolder string, err error) {
-	// Create folder to store HLS video in
-	videoFolder = path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
-	err = os.Mkdir(videoFolder, 0755)
-	if err != nil {
-		return "", err
-	}
+// Private Functions
 
+// Transcodes the whole video with one ffmpeg process
+func transcodeWholeToHLS(ctx context.Context, videoFile, videoFolder, videoUUID string, profile EncodingProfile, metadata *VideoMetadata, renditions []hlsRendition, outputRange string, loudness *LoudnessMeasurement) error {
 	// Build the ffmpeg command that transcodes the given video to multiple HLS streams of different resolutions
-	ffmpegArgs, err := buildFfmpegCommand(videoFile, videoFolder)
+	ffmpegArgs, err := buildFfmpegCommand(videoFile, videoFolder, profile, metadata, renditions, outputRange, loudness)
 	if err != nil {
-		return "", errors.New("Failed to build ffmpeg command: " + err.Error())
+		return errors.New("Failed to build ffmpeg command: " + err.Error())
 	}
 	log.Debug().Msg(strings.Join(ffmpegArgs, " "))
 
 	// Convert video
-	cmd := exec.Command(viper.GetString("ffmpeg.ffmpegDir"), ffmpegArgs...)
-
 	log.Info().Msgf("Converting %s to HLS...\n", videoFile)
+	return runFfmpeg(ctx, ffmpegArgs, func(stdout io.ReadCloser) {
+		updateEncodeFrameProgress(stdout, videoUUID)
+	})
+}
+
+// Runs ffmpeg with the given arguments, passing its `-progress` output to readProgress and logging its errors
+func runFfmpeg(ctx context.Context, ffmpegArgs []string, readProgress func(stdout io.ReadCloser)) error {
+	cmd := exec.CommandContext(ctx, viper.GetString("ffmpeg.ffmpegDir"), ffmpegArgs...)
+
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return "", err
+		return err
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return "", err
+		return err
 	}
 	err = cmd.Start()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	// Create a listener for ffmpeg's output to update `encodingVideos`
-	go updateEncodeFrameProgress(stdout, videoUUID)
+	// Create a listener for ffmpeg's progress output
+	progressDone := make(chan struct{})
+	go func() {
+		readProgress(stdout)
+		close(progressDone)
+	}()
 	go logStdErr(stderr)
 
-	err = cmd.Wait()
-	if err != nil {
-		return "", err
-	}
-
-	return videoFolder, nil
-}
-
-// Private Functions
-
-// Uses ffmpeg to get the height and width of given video (as a string)
-func getVideoResolution(videoFile string) (string, error) {
-	cmd := exec.Command(viper.GetString("ffmpeg.ffprobeDir"), "-i", videoFile, "-show_entries", "stream=width,height", "-v", "quiet", "-of", `csv=s=x:p=0`)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", errors.New(string(out) + " | " + err.Error())
-	}
-
-	return strings.TrimSpace(string(out)), nil
+	// All output must be read before waiting on the command, since waiting closes the pipes
+	<-progressDone
+	return cmd.Wait()
 }
 
 // FFMPEG command building
 
-func buildFfmpegFilter(numResolutions int) []string {
+func buildFfmpegFilter(renditions []hlsRendition, videoStreamIndex int, toneMap bool) []string {
 	ffmpegFilter := []string{"-filter_complex"}
-	filterString := fmt.Sprintf("[0:v]split=%d", numResolutions)
+	numResolutions := len(renditions)
+	filterString := fmt.Sprintf("[0:%d]", videoStreamIndex)
+
+	// Convert HDR sources to SDR before scaling so every rendition shares the conversion
+	if toneMap {
+		filterString += toneMapFilter + ","
+	}
+
+	filterString += fmt.Sprintf("split=%d", numResolutions)
 
 	// Split the video into numResolutions parts
 	for i := 0; i < numResolutions; i++ {
@@ -167,7 +266,7 @@ func buildFfmpegFilter(numResolutions int) []string {
 
 	// Scale each stream to the appropriate resolution
 	for i := 0; i < numResolutions; i++ {
-		filterString += fmt.Sprintf("[v%d]scale=h=%d:w=%d:force_original_aspect_ratio=increase:force_divisible_by=2[v%dout]", i+1, standardVideoHeights[i], standardVideoWidths[i], i+1)
+		filterString += fmt.Sprintf("[v%d]scale=h=%d:w=%d:force_original_aspect_ratio=increase:force_divisible_by=2[v%dout]", i+1, renditions[i].height, renditions[i].width, i+1)
 		if (i + 1) < numResolutions {
 			filterString += "; "
 		}
@@ -178,38 +277,91 @@ func buildFfmpegFilter(numResolutions int) []string {
 	return ffmpegFilter
 }
 
-func buildFfmpegVideoStreamParams(numResolutions int) []string {
+func buildFfmpegVideoStreamParams(renditions []hlsRendition, profile EncodingProfile, sourceRange, outputRange string) []string {
 	ffmpegVideoStreamParams := []string{}
 
-	for i := 0; i < numResolutions; i++ {
-		ffmpegVideoStreamParams = append(ffmpegVideoStreamParams, "-map", fmt.Sprintf("[v%dout]", i+1), fmt.Sprintf("-c:v:%d", i), "libx264", fmt.Sprintf("-b:v:%d", i), resolutionBitRates[int(standardVideoHeights[i])], fmt.Sprintf("-maxrate:v:%d", i), resolutionBitRates[int(standardVideoHeights[i])], fmt.Sprintf("-minrate:v:%d", i), resolutionBitRates[int(standardVideoHeights[i])], fmt.Sprintf("-bufsize:v:%d", i), resolutionBufferSizes[int(standardVideoHeights[i])], "-preset", "fast", "-crf", "20", "-g", "48", "-sc_threshold", "0", "-keyint_min", "48")
+	for i, rendition := range renditions {
+		bitRate := rendition.bitRate
+		bufferSize := rendition.bufferSize
+
+		ffmpegVideoStreamParams = append(ffmpegVideoStreamParams, "-map", fmt.Sprintf("[v%dout]", i+1))
+
+		switch profile.Codec {
+		case CodecHEVC:
+			x265Params := "keyint=48:min-keyint=48:scenecut=0"
+			switch outputRange {
+			case VideoRangePQ:
+				x265Params += ":hdr10-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc"
+			case VideoRangeHLG:
+				x265Params += ":repeat-headers=1:colorprim=bt2020:transfer=arib-std-b67:colormatrix=bt2020nc"
+			}
+			ffmpegVideoStreamParams = append(ffmpegVideoStreamParams, fmt.Sprintf("-c:v:%d", i), "libx265", fmt.Sprintf("-tag:v:%d", i), "hvc1", fmt.Sprintf("-b:v:%d", i), bitRate, fmt.Sprintf("-maxrate:v:%d", i), bitRate, fmt.Sprintf("-bufsize:v:%d", i), bufferSize, "-preset", "fast", fmt.Sprintf("-x265-params:v:%d", i), x265Params)
+		case CodecAV1:
+			ffmpegVideoStreamParams = append(ffmpegVideoStreamParams, fmt.Sprintf("-c:v:%d", i), "libaom-av1", fmt.Sprintf("-b:v:%d", i), bitRate, fmt.Sprintf("-maxrate:v:%d", i), bitRate, fmt.Sprintf("-bufsize:v:%d", i), bufferSize, "-cpu-used", "6", "-row-mt", "1", "-g", "48", "-keyint_min", "48")
+		default:
+			ffmpegVideoStreamParams = append(ffmpegVideoStreamParams, fmt.Sprintf("-c:v:%d", i), "libx264", fmt.Sprintf("-b:v:%d", i), bitRate, fmt.Sprintf("-maxrate:v:%d", i), bitRate, fmt.Sprintf("-minrate:v:%d", i), bitRate, fmt.Sprintf("-bufsize:v:%d", i), bufferSize, "-preset", "fast", "-crf", "20", "-g", "48", "-sc_threshold", "0", "-keyint_min", "48")
+		}
+
+		ffmpegVideoStreamParams = append(ffmpegVideoStreamParams, buildFfmpegColorParams(i, sourceRange, outputRange)...)
 	}
 
 	return ffmpegVideoStreamParams
 }
 
+// Tags the given output stream with the color information of its dynamic range
+func buildFfmpegColorParams(streamIndex int, sourceRange, outputRange string) []string {
+	switch {
+	case outputRange == VideoRangePQ:
+		return []string{fmt.Sprintf("-pix_fmt:v:%d", streamIndex), "yuv420p10le", fmt.Sprintf("-color_primaries:v:%d", streamIndex), "bt2020", fmt.Sprintf("-color_trc:v:%d", streamIndex), "smpte2084", fmt.Sprintf("-colorspace:v:%d", streamIndex), "bt2020nc"}
+	case outputRange == VideoRangeHLG:
+		return []string{fmt.Sprintf("-pix_fmt:v:%d", streamIndex), "yuv420p10le", fmt.Sprintf("-color_primaries:v:%d", streamIndex), "bt2020", fmt.Sprintf("-color_trc:v:%d", streamIndex), "arib-std-b67", fmt.Sprintf("-colorspace:v:%d", streamIndex), "bt2020nc"}
+	case sourceRange != VideoRangeSDR:
+		// Tone-mapped HDR source
+		return []string{fmt.Sprintf("-color_primaries:v:%d", streamIndex), "bt709", fmt.Sprintf("-color_trc:v:%d", streamIndex), "bt709", fmt.Sprintf("-colorspace:v:%d", streamIndex), "bt709"}
+	default:
+		// SDR sources keep whatever color information they were tagged with
+		return []string{}
+	}
+}
+
 // -map a:0 -c:a:0 aac -b:a:0 96k -ac 2
-func buildFfmpegAudioStreamParams(numResolutions int) []string {
+// If a loudness measurement is given, each audio stream is normalized with the second `loudnorm` pass
+func buildFfmpegAudioStreamParams(numResolutions int, profile EncodingProfile, loudness *LoudnessMeasurement) []string {
 	ffmpegAudioStreamParams := []string{}
 
 	for i := 0; i < numResolutions; i++ {
 		ffmpegAudioStreamParams = append(ffmpegAudioStreamParams, "-map", "a:0", fmt.Sprintf("-c:a:%d", i), "aac" /*fmt.Sprintf("-b:a:%d", i), "96k",*/, "-ac", "2")
+		if loudness != nil {
+			ffmpegAudioStreamParams = append(ffmpegAudioStreamParams, fmt.Sprintf("-filter:a:%d", i), buildLoudnormFilter(profile, loudness))
+		}
 	}
 
 	return ffmpegAudioStreamParams
 }
 
-func buildFfmpegHLSParams(videoFolder string) []string {
+func buildFfmpegHLSParams(videoFolder string, profile EncodingProfile) []string {
+	// HEVC and AV1 are only supported by HLS players in fragmented MP4 segments
+	if profile.Codec != CodecH264 {
+		return []string{"-f", "hls", "-hls_time", "2", "-hls_playlist_type", "vod", "-hls_flags", "independent_segments", "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "stream_%v-init.mp4", "-hls_segment_filename", path.Join(videoFolder, "stream_%v-data%02d.m4s"), "-master_pl_name", "master.m3u8"}
+	}
+
 	ffmpegHLSParams := []string{"-f", "hls", "-hls_time", "2", "-hls_playlist_type", "vod", "-hls_flags", "independent_segments", "-hls_segment_type", "mpegts", "-hls_segment_filename", path.Join(videoFolder, "stream_%v-data%02d.ts"), "-master_pl_name", "master.m3u8"}
 	return ffmpegHLSParams
 }
 
-func buildFfmpegVarStreamMapParams(numResolutions int) []string {
+func buildFfmpegVarStreamMapParams(renditions []hlsRendition, hasAudio bool) []string {
 	ffmpegVarStreamMapParams := []string{"-var_stream_map"}
 	streamMap := ""
+	numResolutions := len(renditions)
 
-	for i := 0; i < numResolutions; i++ {
-		streamMap += fmt.Sprintf("v:%d,a:%d", i, i)
+	for i, rendition := range renditions {
+		streamMap += fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			streamMap += fmt.Sprintf(",a:%d", i)
+		}
+		if rendition.name != "" {
+			streamMap += ",name:" + rendition.name
+		}
 		if (i + 1) < numResolutions {
 			streamMap += " "
 		}
@@ -221,46 +373,65 @@ func buildFfmpegVarStreamMapParams(numResolutions int) []string {
 }
 
 // Builds the array of arguments necessary for ffmpeg to properly transcode the given video
-func buildFfmpegCommand(videoFile, videoFolder string) ([]string, error) {
+func buildFfmpegCommand(videoFile, videoFolder string, profile EncodingProfile, metadata *VideoMetadata, renditions []hlsRendition, outputRange string, loudness *LoudnessMeasurement) ([]string, error) {
 	// Initial arguments for formatting ffmpeg's output
 	ffmpegArgs := []string{"-i", videoFile, "-loglevel", "error", "-progress", "-", "-nostats"}
 
-	maxResolutionIndex, err := determineMaxResolutionIndex(videoFile, videoFolder)
-	if err != nil {
-		return nil, err
+	videoStream := firstVideoStream(metadata)
+	if videoStream == nil {
+		return nil, errors.New("no video stream found")
 	}
+	hasAudio := firstAudioStream(metadata) != nil
+
+	sourceRange := streamVideoRange(videoStream)
+	numResolutions := len(renditions)
 
-	outputResolutions := standardVideoHeights[0 : maxResolutionIndex+1]
-	numResolutions := len(outputResolutions)
+	toneMap := sourceRange != outputRange
 
-	ffmpegArgs = append(ffmpegArgs, buildFfmpegFilter(numResolutions)...)
-	ffmpegArgs = append(ffmpegArgs, buildFfmpegVideoStreamParams(numResolutions)...)
-	ffmpegArgs = append(ffmpegArgs, buildFfmpegAudioStreamParams(numResolutions)...)
-	ffmpegArgs = append(ffmpegArgs, buildFfmpegHLSParams(videoFolder)...)
-	ffmpegArgs = append(ffmpegArgs, buildFfmpegVarStreamMapParams(numResolutions)...)
+	ffmpegArgs = append(ffmpegArgs, buildFfmpegFilter(renditions, videoStream.Index, toneMap)...)
+	ffmpegArgs = append(ffmpegArgs, buildFfmpegVideoStreamParams(renditions, profile, sourceRange, outputRange)...)
+	if hasAudio {
+		ffmpegArgs = append(ffmpegArgs, buildFfmpegAudioStreamParams(numResolutions, profile, loudness)...)
+	}
+	ffmpegArgs = append(ffmpegArgs, buildFfmpegHLSParams(videoFolder, profile)...)
+	ffmpegArgs = append(ffmpegArgs, buildFfmpegVarStreamMapParams(renditions, hasAudio)...)
 	ffmpegArgs = append(ffmpegArgs, path.Join(videoFolder, "stream_%v.m3u8"))
 
 	return ffmpegArgs, nil
 }
 
-func determineMaxResolutionIndex(videoFile, videoFolder string) (int, error) {
-	// Get the resolution of the current video
-	videoResolution, err := getVideoResolution(videoFile)
-	if err != nil {
-		return 0, err
+// Name ffmpeg gives the files of the rendition at the index in place of `%v`
+func (rendition hlsRendition) streamName(index int) string {
+	if rendition.name != "" {
+		return rendition.name
 	}
+	return strconv.Itoa(index)
+}
 
-	videoHeight, err := strconv.ParseInt(strings.Split(videoResolution, "x")[1], 10, 64)
-	if err != nil {
-		return 0, err
+// Returns the renditions of the standard ladder that the video is transcoded to, up to its own resolution and the profile's top rung.
+// The lowest rung is always kept, so every video has at least one rendition.
+func ladderRenditions(videoStream *StreamMetadata, profile EncodingProfile) []hlsRendition {
+	renditions := []hlsRendition{}
+	for i := 0; i <= determineMaxResolutionIndex(videoStream); i++ {
+		if i > 0 && profile.MaxRenditionHeight > 0 && standardVideoHeights[i] > profile.MaxRenditionHeight {
+			break
+		}
+		height := int(standardVideoHeights[i])
+		renditions = append(renditions, hlsRendition{width: standardVideoWidths[i], height: standardVideoHeights[i], bitRate: resolutionBitRates[height], bufferSize: resolutionBufferSizes[height]})
 	}
+	return renditions
+}
+
+func determineMaxResolutionIndex(videoStream *StreamMetadata) int {
+	// Get the resolution of the current video as it is displayed
+	_, videoHeight := displayResolution(videoStream)
 
 	// Find the maximum resolution to scale the video to
 	maxResolutionIndex := len(standardVideoHeights) - 1
-	for ; maxResolutionIndex > 0 && videoHeight < int64(standardVideoHeights[maxResolutionIndex]); maxResolutionIndex-- {
+	for ; maxResolutionIndex > 0 && int64(videoHeight) < standardVideoHeights[maxResolutionIndex]; maxResolutionIndex-- {
 	}
 
-	return maxResolutionIndex, nil
+	return maxResolutionIndex
 }
 
 func logStdErr(ffmpegStdErr io.ReadCloser) {
@@ -269,47 +440,3 @@ func logStdErr(ffmpegStdErr io.ReadCloser) {
 		log.Error().Str("ffmpeg", "stderr").Msg(scanner.Text())
 	}
 }
-
-// Updates the encoding map with the progress of the video encode job
-func updateEncodeFrameProgress(ffmpegStdOut io.ReadCloser, videoUUID string) {
-	// Read until the end of the ffmpeg command
-	buf := make([]byte, 1<<10)
-	for endOfFile := false; !endOfFile; {
-		_, err := ffmpegStdOut.Read(buf)
-		if err == io.EOF {
-			endOfFile = true
-			continue
-		} else if err != nil {
-			log.Error().Msgf("Error updating video progress: %s\n", err)
-			endOfFile = true
-			continue
-		}
-
-		// Take the frame count out of the output of ffmpeg
-		output := strings.Trim(string(buf), "\u0000")
-		log.Debug().Str("ffmpeg", "stdout").Msg(output)
-		frameLine := strings.Split(output, "\n")[0]
-		frameCountStr := strings.Split(frameLine, "=")[1]
-		frameCount, err := strconv.ParseInt(frameCountStr, 10, 64)
-		if err != nil {
-			log.Error().Msgf("Error updating video progress: %s\n", err)
-			endOfFile = true
-			continue
-		}
-
-		EncodingVideos.mutex.Lock()
-		// Calculate the progress percentage
-		encodingProgress := int64(math.Floor(float64(frameCount) * 100 / float64(EncodingVideos.Videos[videoUUID].TotalFrames)))
-		// Update the encoding map
-		tempStruct := EncodingVideo{TotalFrames: EncodingVideos.Videos[videoUUID].TotalFrames, CurrentProgress: encodingProgress}
-		EncodingVideos.Videos[videoUUID] = tempStruct
-		EncodingVideos.mutex.Unlock()
-	}
-
-	// When the stdout reader is closed, ffmpeg has finished
-	// Update the encoding map to signal that the job has completed
-	EncodingVideos.mutex.Lock()
-	tempStruct := EncodingVideo{TotalFrames: EncodingVideos.Videos[videoUUID].TotalFrames, CurrentProgress: 100}
-	EncodingVideos.Videos[videoUUID] = tempStruct
-	EncodingVideos.mutex.Unlock()
-}
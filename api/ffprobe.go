@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gatsby-tv/dapper/types"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Metadata of a video file as reported by ffprobe
+type VideoMetadata = types.VideoMetadata
+
+// Metadata of a single stream within a video file
+type StreamMetadata = types.StreamMetadata
+
+// A chapter marker within a video file
+type ChapterMetadata = types.ChapterMetadata
+
+// Output of `ffprobe -print_format json -show_format -show_streams -show_chapters`
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		Size       string            `json:"size"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		Index         int               `json:"index"`
+		CodecType     string            `json:"codec_type"`
+		CodecName     string            `json:"codec_name"`
+		Profile       string            `json:"profile"`
+		BitRate       string            `json:"bit_rate"`
+		Width         int               `json:"width"`
+		Height        int               `json:"height"`
+		AvgFrameRate  string            `json:"avg_frame_rate"`
+		RFrameRate    string            `json:"r_frame_rate"`
+		NbFrames      string            `json:"nb_frames"`
+		PixFmt        string            `json:"pix_fmt"`
+		ColorRange    string            `json:"color_range"`
+		ColorSpace    string            `json:"color_space"`
+		ColorTransfer string            `json:"color_transfer"`
+		ColorPrim     string            `json:"color_primaries"`
+		SampleRate    string            `json:"sample_rate"`
+		Channels      int               `json:"channels"`
+		ChannelLayout string            `json:"channel_layout"`
+		Tags          map[string]string `json:"tags"`
+		Disposition   struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+		SideDataList []struct {
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		EndTime   string            `json:"end_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+// Functions used outside of this file
+
+// Uses `ffprobe` to read the container, stream and chapter metadata of the given video
+func probeVideo(videoFile string) (*VideoMetadata, error) {
+	cmd := exec.Command(viper.GetString("ffmpeg.ffprobeDir"), "-i", videoFile, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", "-show_chapters")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, ffprobeError(err)
+	}
+
+	var probe ffprobeOutput
+	err = json.Unmarshal(out, &probe)
+	if err != nil {
+		return nil, err
+	}
+
+	// ffprobe reports numbers that may be unknown as strings, unknown values are left as zero
+	metadata := &VideoMetadata{
+		Container: probe.Format.FormatName,
+		Tags:      probe.Format.Tags,
+	}
+	metadata.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	metadata.Size, _ = strconv.ParseInt(probe.Format.Size, 10, 64)
+	metadata.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+
+	for _, stream := range probe.Streams {
+		streamMetadata := StreamMetadata{
+			Index:           stream.Index,
+			Type:            stream.CodecType,
+			Codec:           stream.CodecName,
+			Profile:         stream.Profile,
+			Language:        stream.Tags["language"],
+			Tags:            stream.Tags,
+			Width:           stream.Width,
+			Height:          stream.Height,
+			PixelFormat:     stream.PixFmt,
+			ColorRange:      stream.ColorRange,
+			ColorSpace:      stream.ColorSpace,
+			ColorTransfer:   stream.ColorTransfer,
+			ColorPrimaries:  stream.ColorPrim,
+			Channels:        stream.Channels,
+			ChannelLayout:   stream.ChannelLayout,
+			AttachedPicture: stream.Disposition.AttachedPic == 1,
+		}
+		streamMetadata.Bitrate, _ = strconv.ParseInt(stream.BitRate, 10, 64)
+		streamMetadata.Frames, _ = strconv.ParseInt(stream.NbFrames, 10, 64)
+		streamMetadata.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+
+		// Prefer the average frame rate, which handles variable frame rate sources
+		if frameRate, err := parseFrameRate(stream.AvgFrameRate); err == nil {
+			streamMetadata.FrameRate = frameRate
+		} else if frameRate, err := parseFrameRate(stream.RFrameRate); err == nil {
+			streamMetadata.FrameRate = frameRate
+		}
+
+		// Older containers store rotation as a tag, newer ffprobe versions report it in the display matrix.
+		// The display matrix rotation is counterclockwise.
+		if rotation, err := strconv.Atoi(stream.Tags["rotate"]); err == nil {
+			streamMetadata.Rotation = rotation
+		}
+		for _, sideData := range stream.SideDataList {
+			if sideData.Rotation != 0 {
+				streamMetadata.Rotation = int(-sideData.Rotation)
+			}
+		}
+		streamMetadata.Rotation = ((streamMetadata.Rotation % 360) + 360) % 360
+
+		metadata.Streams = append(metadata.Streams, streamMetadata)
+	}
+
+	for _, chapter := range probe.Chapters {
+		chapterMetadata := ChapterMetadata{Title: chapter.Tags["title"]}
+		chapterMetadata.Start, _ = strconv.ParseFloat(chapter.StartTime, 64)
+		chapterMetadata.End, _ = strconv.ParseFloat(chapter.EndTime, 64)
+		metadata.Chapters = append(metadata.Chapters, chapterMetadata)
+	}
+
+	return metadata, nil
+}
+
+// Gets the number of frames in the given video.
+// The frame count in the container is used if it has one, otherwise the packets of the video stream are counted.
+// If neither is available the count is estimated from the frame rate and duration.
+// Returns 0 if the number of frames cannot be determined, in which case progress is tracked by time instead.
+func getVideoFrames(videoFile string, metadata *VideoMetadata) (int64, error) {
+	stream := firstVideoStream(metadata)
+	if stream == nil {
+		return 0, errors.New("no video stream found")
+	}
+
+	// Containers like MP4 store the number of frames in their header
+	if stream.Frames > 0 {
+		return stream.Frames, nil
+	}
+
+	// Otherwise demux the video stream and count its packets
+	if frames, err := countVideoPackets(videoFile, stream.Index); err == nil && frames > 0 {
+		return frames, nil
+	} else if err != nil {
+		log.Warn().Msgf("Unable to count video packets of %s: %s", videoFile, err)
+	}
+
+	if stream.FrameRate <= 0 || metadata.Duration <= 0 {
+		return 0, nil
+	}
+
+	return int64(math.Round(stream.FrameRate * metadata.Duration)), nil
+}
+
+// Returns the first video stream of the video, or nil if it has none
+func firstVideoStream(metadata *VideoMetadata) *StreamMetadata {
+	for i := range metadata.Streams {
+		// Cover art is reported as a video stream, so skip attached pictures
+		if metadata.Streams[i].Type == "video" && !metadata.Streams[i].AttachedPicture {
+			return &metadata.Streams[i]
+		}
+	}
+	return nil
+}
+
+// Returns the first audio stream of the video, or nil if it has none
+func firstAudioStream(metadata *VideoMetadata) *StreamMetadata {
+	for i := range metadata.Streams {
+		if metadata.Streams[i].Type == "audio" {
+			return &metadata.Streams[i]
+		}
+	}
+	return nil
+}
+
+// Length of the video in seconds, ceilinged to the next largest int
+func videoLength(metadata *VideoMetadata) int {
+	return int(math.Ceil(metadata.Duration))
+}
+
+// Width and height of the video stream as it is displayed, taking rotation into account
+func displayResolution(stream *StreamMetadata) (width, height int) {
+	if stream.Rotation == 90 || stream.Rotation == 270 {
+		return stream.Height, stream.Width
+	}
+	return stream.Width, stream.Height
+}
+
+// Determines the dynamic range of the video stream from its color transfer characteristics
+func streamVideoRange(stream *StreamMetadata) string {
+	switch stream.ColorTransfer {
+	case "smpte2084":
+		return VideoRangePQ
+	case "arib-std-b67":
+		return VideoRangeHLG
+	default:
+		return VideoRangeSDR
+	}
+}
+
+// Private Functions
+
+// Uses `ffprobe` to count the packets in the stream with the given index, which matches its number of frames
+func countVideoPackets(videoFile string, streamIndex int) (int64, error) {
+	cmd := exec.Command(viper.GetString("ffmpeg.ffprobeDir"), "-i", videoFile, "-count_packets", "-show_entries", "stream=nb_read_packets", "-v", "error", "-of", `csv=p=0`, "-select_streams", strconv.Itoa(streamIndex))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, errors.New(string(out) + " | " + err.Error())
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// Parses a frame rate given as a rational number by ffprobe (ex. "30000/1001")
+func parseFrameRate(frameRate string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(frameRate), "/")
+	numerator, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	denominator := 1.0
+	if len(parts) > 1 {
+		denominator, err = strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// ffprobe reports "0/0" when the frame rate is unknown
+	if numerator <= 0 || denominator <= 0 {
+		return 0, fmt.Errorf("invalid frame rate %q", frameRate)
+	}
+
+	return numerator / denominator, nil
+}
+
+// Includes the stderr output of a failed ffprobe command in its error.
+// Used when stdout is parsed as JSON, since stderr cannot be combined with it.
+func ffprobeError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return errors.New(strings.TrimSpace(string(exitErr.Stderr)) + " | " + err.Error())
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseFrameRate(t *testing.T) {
+	frameRates := map[string]float64{
+		"30/1":       30,
+		"30000/1001": 30000.0 / 1001,
+		"24000/1001": 24000.0 / 1001,
+		"25":         25,
+		" 60/1\n":    60,
+	}
+	for frameRate, want := range frameRates {
+		got, err := parseFrameRate(frameRate)
+		if err != nil || !approxEqual(got, want) {
+			t.Errorf("parseFrameRate(%q) = %v, %v, want %v", frameRate, got, err, want)
+		}
+	}
+
+	// ffprobe reports unknown frame rates as "0/0"
+	for _, frameRate := range []string{"0/0", "30/0", "-30/1", "", "N/A", "30/x"} {
+		if got, err := parseFrameRate(frameRate); err == nil {
+			t.Errorf("parseFrameRate(%q) = %v, want an error", frameRate, got)
+		}
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gatsby-tv/dapper/ipfs"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// Response given by dapper to a GET to "/readyz"
+type ReadinessResponse struct {
+	Ready  bool                `json:"ready"`
+	Checks []HealthCheckResult `json:"checks"`
+}
+
+// Result of checking one of dapper's dependencies
+type HealthCheckResult struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Version of ffmpeg, ffprobe or the IPFS node
+	Version string `json:"version,omitempty"`
+	// Bytes free on the disk holding a folder
+	FreeBytes uint64 `json:"freeBytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Defaults used when the health check limits are not configured
+const (
+	defaultMinFreeSpace       = "1GB"
+	defaultHealthCheckTimeout = 10 * time.Second
+)
+
+// Routes
+
+// GETs
+
+// Responds as long as dapper is able to handle requests
+func liveness(c echo.Context) error {
+	return c.String(http.StatusOK, "OK")
+}
+
+// Checks that ffmpeg, ffprobe, the storage folders and the IPFS node are all usable.
+// Responds with a 503 if any of them are not, so no new jobs are routed to dapper.
+func readiness(c echo.Context) error {
+	timeout := viper.GetDuration("Health.CheckTimeout")
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+	defer cancel()
+
+	minFreeSpace, err := healthMinFreeSpace()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	tempFolder := viper.GetString("Videos.TempVideoStorageFolder")
+	scratchFolder := path.Join(tempFolder, VideoScratchFolder)
+	checks := []func() HealthCheckResult{
+		func() HealthCheckResult { return checkBinary(ctx, "ffmpeg", viper.GetString("ffmpeg.ffmpegDir")) },
+		func() HealthCheckResult { return checkBinary(ctx, "ffprobe", viper.GetString("ffmpeg.ffprobeDir")) },
+		func() HealthCheckResult { return checkFolder("scratch", scratchFolder, minFreeSpace) },
+		func() HealthCheckResult { return checkFolder("temp", tempFolder, minFreeSpace) },
+		func() HealthCheckResult { return checkIPFS(ctx) },
+	}
+
+	// Run the checks at the same time so a slow dependency does not delay the others
+	response := ReadinessResponse{Ready: true, Checks: make([]HealthCheckResult, len(checks))}
+	var wg sync.WaitGroup
+	wg.Add(len(checks))
+	for i, check := range checks {
+		go func(i int, check func() HealthCheckResult) {
+			defer wg.Done()
+			response.Checks[i] = check()
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, check := range response.Checks {
+		response.Ready = response.Ready && check.OK
+	}
+
+	if !response.Ready {
+		return c.JSON(http.StatusServiceUnavailable, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// Private Functions
+
+// Minimum free space the storage folders need to be ready, from `Health.MinFreeSpace`
+func healthMinFreeSpace() (uint64, error) {
+	minFreeSpace := viper.GetString("Health.MinFreeSpace")
+	if minFreeSpace == "" {
+		minFreeSpace = defaultMinFreeSpace
+	}
+
+	bytes, err := humanize.ParseBytes(minFreeSpace)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Health.MinFreeSpace: %s", err)
+	}
+	return bytes, nil
+}
+
+// Runs the binary with `-version` and reads its version from the first line of output
+func checkBinary(ctx context.Context, name, binary string) HealthCheckResult {
+	result := HealthCheckResult{Name: name}
+
+	output, err := exec.CommandContext(ctx, binary, "-version").Output()
+	if err != nil {
+		result.Error = fmt.Sprintf("failed running %s: %s", binary, err)
+		return result
+	}
+
+	// The first line looks like "ffmpeg version 4.4.1 Copyright (c) ..."
+	fields := strings.Fields(strings.SplitN(string(output), "\n", 2)[0])
+	if len(fields) < 3 || fields[1] != "version" {
+		result.Error = fmt.Sprintf("unexpected version output from %s", binary)
+		return result
+	}
+
+	result.OK = true
+	result.Version = fields[2]
+	return result
+}
+
+// Checks that a file can be written to the folder and that its disk has enough free space
+func checkFolder(name, folder string, minFreeSpace uint64) HealthCheckResult {
+	result := HealthCheckResult{Name: name}
+
+	file, err := os.CreateTemp(folder, ".readyz-*")
+	if err != nil {
+		result.Error = fmt.Sprintf("folder is not writable: %s", err)
+		return result
+	}
+	_, err = file.Write([]byte("ok"))
+	file.Close()
+	os.Remove(file.Name())
+	if err != nil {
+		result.Error = fmt.Sprintf("folder is not writable: %s", err)
+		return result
+	}
+
+	_, _, result.FreeBytes, err = diskSpace(folder)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed getting free space: %s", err)
+		return result
+	}
+	if result.FreeBytes < minFreeSpace {
+		result.Error = fmt.Sprintf("only %s free, at least %s is required", humanize.Bytes(result.FreeBytes), humanize.Bytes(minFreeSpace))
+		return result
+	}
+
+	result.OK = true
+	return result
+}
+
+// Checks that the IPFS node videos are pinned with answers
+func checkIPFS(ctx context.Context) HealthCheckResult {
+	result := HealthCheckResult{Name: "ipfs"}
+
+	version, err := ipfs.GetVersion(ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.OK = true
+	result.Version = version
+	return result
+}
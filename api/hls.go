@@ -0,0 +1,206 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Playlist version required by a `VIDEO-RANGE` of PQ or HLG
+const hdrPlaylistVersion = 8
+
+// Adds the `VIDEO-RANGE` attribute to every variant stream in the given master playlist.
+// HDR ranges need a newer playlist version, so the version is raised for them if it is lower.
+func tagMasterPlaylistVideoRange(masterPlaylist, videoRange string) error {
+	playlist, err := os.ReadFile(masterPlaylist)
+	if err != nil {
+		return err
+	}
+
+	raiseVersion := videoRange != VideoRangeSDR && playlistVersion(string(playlist)) < hdrPlaylistVersion
+	hasVersion := strings.Contains(string(playlist), "#EXT-X-VERSION:")
+
+	lines := []string{}
+	for _, line := range strings.Split(string(playlist), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:") && !strings.Contains(line, "VIDEO-RANGE="):
+			line = strings.TrimRight(line, "\r") + ",VIDEO-RANGE=" + videoRange
+		case strings.HasPrefix(line, "#EXT-X-VERSION:") && raiseVersion:
+			line = "#EXT-X-VERSION:" + strconv.Itoa(hdrPlaylistVersion)
+		}
+		lines = append(lines, line)
+
+		if strings.HasPrefix(line, "#EXTM3U") && raiseVersion && !hasVersion {
+			lines = append(lines, "#EXT-X-VERSION:"+strconv.Itoa(hdrPlaylistVersion))
+		}
+	}
+
+	return os.WriteFile(masterPlaylist, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// A variant stream listed in a master playlist
+type hlsVariant struct {
+	uri       string
+	bandwidth int64
+	width     int64
+	height    int64
+	// Codecs of the variant's streams, such as "avc1.64001f" and "mp4a.40.2"
+	codecs []string
+	// The tag and URI lines of the variant, as they appear in the playlist
+	lines []string
+}
+
+// Returns the variant streams listed in the given master playlist
+func masterPlaylistVariants(masterPlaylist string) ([]hlsVariant, error) {
+	playlist, err := os.ReadFile(masterPlaylist)
+	if err != nil {
+		return nil, err
+	}
+
+	variants := []hlsVariant{}
+	var variant *hlsVariant
+	for _, line := range strings.Split(string(playlist), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attributes := parseAttributeList(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			variant = &hlsVariant{lines: []string{line}}
+			variant.bandwidth, _ = strconv.ParseInt(attributes["BANDWIDTH"], 10, 64)
+			if resolution := strings.SplitN(attributes["RESOLUTION"], "x", 2); len(resolution) == 2 {
+				variant.width, _ = strconv.ParseInt(resolution[0], 10, 64)
+				variant.height, _ = strconv.ParseInt(resolution[1], 10, 64)
+			}
+			if attributes["CODECS"] != "" {
+				variant.codecs = strings.Split(attributes["CODECS"], ",")
+			}
+		case line != "" && !strings.HasPrefix(line, "#") && variant != nil:
+			// The URI of a variant stream is on the line after its tag
+			variant.uri = line
+			variant.lines = append(variant.lines, line)
+			variants = append(variants, *variant)
+			variant = nil
+		}
+	}
+
+	return variants, nil
+}
+
+// Returns the URI of the variant stream with the highest bandwidth in the given master playlist
+func highestBandwidthVariant(masterPlaylist string) (string, error) {
+	variants, err := masterPlaylistVariants(masterPlaylist)
+	if err != nil {
+		return "", err
+	}
+	if len(variants) == 0 {
+		return "", errors.New("master playlist has no variant streams")
+	}
+
+	highest := variants[0]
+	for _, variant := range variants[1:] {
+		if variant.bandwidth > highest.bandwidth {
+			highest = variant
+		}
+	}
+	return highest.uri, nil
+}
+
+// Adds the variant streams of the added master playlist to the existing one, writing the result to the added playlist.
+// The playlist version is raised to the higher of the two, since added variants may use newer features such as fMP4 segments.
+func mergeMasterPlaylists(existingPlaylist, addedPlaylist string) error {
+	existing, err := os.ReadFile(existingPlaylist)
+	if err != nil {
+		return err
+	}
+	added, err := os.ReadFile(addedPlaylist)
+	if err != nil {
+		return err
+	}
+	addedVariants, err := masterPlaylistVariants(addedPlaylist)
+	if err != nil {
+		return err
+	}
+
+	version := playlistVersion(string(existing))
+	if addedVersion := playlistVersion(string(added)); addedVersion > version {
+		version = addedVersion
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(existing), "\r\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			line = "#EXT-X-VERSION:" + strconv.Itoa(version)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r"))
+	}
+	for _, variant := range addedVariants {
+		lines = append(lines, variant.lines...)
+	}
+
+	return os.WriteFile(addedPlaylist, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// Returns the `EXT-X-VERSION` of the playlist, 1 if it has none
+func playlistVersion(playlist string) int {
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			if version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "#EXT-X-VERSION:"))); err == nil {
+				return version
+			}
+		}
+	}
+	return 1
+}
+
+// Parses an HLS attribute list, such as `BANDWIDTH=1000,CODECS="avc1.64001f,mp4a.40.2"`, removing the quotes from quoted values
+func parseAttributeList(list string) map[string]string {
+	attributes := map[string]string{}
+	for list != "" {
+		nameAndRest := strings.SplitN(list, "=", 2)
+		if len(nameAndRest) != 2 {
+			break
+		}
+		name, rest := strings.TrimSpace(nameAndRest[0]), nameAndRest[1]
+
+		// Quoted values can contain commas, so they end at the closing quote rather than the next comma.
+		// A value missing its closing quote runs to the end of the list.
+		end := strings.Index(rest, ",")
+		if strings.HasPrefix(rest, `"`) {
+			end = strings.Index(rest[1:], `"`)
+			if end >= 0 {
+				end += 2
+			}
+		}
+		if end < 0 {
+			end = len(rest)
+		}
+
+		attributes[name] = strings.Trim(rest[:end], `"`)
+		list = strings.TrimPrefix(rest[end:], ",")
+	}
+	return attributes
+}
+
+// Returns the URIs of the init segment and media segments in the given media playlist
+func mediaPlaylistFiles(mediaPlaylist string) ([]string, error) {
+	playlist, err := os.ReadFile(mediaPlaylist)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, line := range strings.Split(string(playlist), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			if start := strings.Index(line, `URI="`); start >= 0 {
+				uri := strings.SplitN(line[start+len(`URI="`):], `"`, 2)[0]
+				files = append(files, uri)
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			files = append(files, line)
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseAttributeList(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want map[string]string
+	}{
+		{
+			name: "plain values",
+			list: "BANDWIDTH=1000,RESOLUTION=1920x1080",
+			want: map[string]string{"BANDWIDTH": "1000", "RESOLUTION": "1920x1080"},
+		},
+		{
+			name: "quoted value with commas",
+			list: `BANDWIDTH=5000000,CODECS="avc1.640028,mp4a.40.2",RESOLUTION=1920x1080`,
+			want: map[string]string{"BANDWIDTH": "5000000", "CODECS": "avc1.640028,mp4a.40.2", "RESOLUTION": "1920x1080"},
+		},
+		{
+			name: "quoted value last",
+			list: `URI="stream_0_init.mp4"`,
+			want: map[string]string{"URI": "stream_0_init.mp4"},
+		},
+		{
+			name: "empty quoted value",
+			list: `URI="",BANDWIDTH=1`,
+			want: map[string]string{"URI": "", "BANDWIDTH": "1"},
+		},
+		{
+			name: "unterminated quote runs to the end",
+			list: `BANDWIDTH=1,URI="stream_0_init.mp4`,
+			want: map[string]string{"BANDWIDTH": "1", "URI": "stream_0_init.mp4"},
+		},
+		{
+			name: "value with an equals sign",
+			list: `URI="init.mp4?a=b",BYTERANGE=100`,
+			want: map[string]string{"URI": "init.mp4?a=b", "BYTERANGE": "100"},
+		},
+		{
+			name: "trailing attribute without a value is dropped",
+			list: "BANDWIDTH=1,AUTOSELECT",
+			want: map[string]string{"BANDWIDTH": "1"},
+		},
+		{
+			name: "empty",
+			list: "",
+			want: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseAttributeList(test.list); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseAttributeList(%q) = %v, want %v", test.list, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeMasterPlaylists(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		added    string
+		want     string
+	}{
+		{
+			name: "added variants follow the existing ones",
+			existing: "#EXTM3U\n#EXT-X-VERSION:3\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.64001e,mp4a.40.2\"\nstream_0.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\"\nstream_1.m3u8\n",
+			added: "#EXTM3U\n#EXT-X-VERSION:3\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,CODECS=\"avc1.640028,mp4a.40.2\"\nstream_h264-1080.m3u8\n",
+			want: "#EXTM3U\n#EXT-X-VERSION:3\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.64001e,mp4a.40.2\"\nstream_0.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\"\nstream_1.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,CODECS=\"avc1.640028,mp4a.40.2\"\nstream_h264-1080.m3u8\n",
+		},
+		{
+			name: "version raised for fMP4 variants",
+			existing: "#EXTM3U\n#EXT-X-VERSION:3\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nstream_0.m3u8\n",
+			added: "#EXTM3U\n#EXT-X-VERSION:7\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1600000,RESOLUTION=1920x1080,CODECS=\"hvc1.1.6.L120.90,mp4a.40.2\"\nstream_hevc-1080.m3u8\n",
+			want: "#EXTM3U\n#EXT-X-VERSION:7\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nstream_0.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1600000,RESOLUTION=1920x1080,CODECS=\"hvc1.1.6.L120.90,mp4a.40.2\"\nstream_hevc-1080.m3u8\n",
+		},
+		{
+			name: "higher existing version is kept",
+			existing: "#EXTM3U\r\n#EXT-X-VERSION:8\r\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,VIDEO-RANGE=PQ\r\nstream_0.m3u8\r\n",
+			added: "#EXTM3U\n#EXT-X-VERSION:7\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1600000\nstream_av1-1080.m3u8\n",
+			want: "#EXTM3U\n#EXT-X-VERSION:8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,VIDEO-RANGE=PQ\nstream_0.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1600000\nstream_av1-1080.m3u8\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			folder := t.TempDir()
+			existingPlaylist, addedPlaylist := path.Join(folder, "existing.m3u8"), path.Join(folder, "master.m3u8")
+			writeTestFile(t, existingPlaylist, test.existing)
+			writeTestFile(t, addedPlaylist, test.added)
+
+			if err := mergeMasterPlaylists(existingPlaylist, addedPlaylist); err != nil {
+				t.Fatalf("mergeMasterPlaylists() failed: %s", err)
+			}
+			if got := readTestFile(t, addedPlaylist); got != test.want {
+				t.Errorf("mergeMasterPlaylists() wrote\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, file string) string {
+	t.Helper()
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
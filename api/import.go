@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gatsby-tv/dapper/ipfs"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Body of a POST to "/video/import"
+type VideoImportRequest struct {
+	// CID of a video file, or of a folder of HLS streams transcoded by dapper
+	CID string `json:"cid"`
+	// Encoding profile the video is transcoded with, empty for the default profile
+	Profile string `json:"profile"`
+}
+
+// Largest playlist fetched from IPFS, the playlists dapper writes are a few kilobytes
+const maxFetchedPlaylistSize = 1 << 20
+
+// Routes
+
+// POSTs
+
+// Re-encodes content already on IPFS.
+// The source is fetched from the IPFS node, transcoded like an upload, and pinned under a new CID,
+// which is given in the job's status alongside the CID it was imported from.
+func importVideo(c echo.Context) error {
+	request := VideoImportRequest{}
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid import request: "+err.Error())
+	}
+
+	request.CID = strings.TrimPrefix(request.CID, "/ipfs/")
+	if err := ipfs.ValidatePath(request.CID); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid CID: %s", err))
+	}
+
+	apiKeyName := requestAPIKeyName(c)
+	profile, err := getJobProfile(request.Profile, apiKeyName)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid encoding profile: %s", err))
+	}
+
+	// The length of the video is not known until it is fetched, so only the job slot can be reserved now
+	videoUUID := uuid.New().String()
+	if exceeded := reserveQuota(videoUUID, apiKeyName, 0, 0); exceeded != nil {
+		return exceeded.reject(c)
+	}
+
+	startImportJob(videoUUID, EncodingVideo{APIKey: apiKeyName, SourceCID: request.CID, CreatedAt: time.Now(), profile: profile})
+
+	return c.JSON(http.StatusAccepted, VideoStartEncodingResponse{ID: videoUUID})
+}
+
+// Private Functions
+
+// Adds a fetching entry for the imported video to the encoding map, then fetches and transcodes it asynchronously.
+// The entry must have its source CID and profile set.
+func startImportJob(videoUUID string, video EncodingVideo) {
+	ctx, cancel := context.WithCancel(context.Background())
+	video.State = JobFetching
+	video.TotalFrames = 1
+	video.cancel = cancel
+
+	insertJob(videoUUID, video)
+
+	log.Info().Msgf("Importing %s as %s", video.SourceCID, videoUUID)
+	startJob(func() { asyncVideoImport(ctx, videoUUID, video.SourceCID, video.APIKey, video.profile) })
+}
+
+// Fetches the imported video into the scratch folder and checks it the way uploads are checked, then transcodes and pins it
+func asyncVideoImport(ctx context.Context, videoUUID, sourceCID, apiKeyName string, profile EncodingProfile) {
+	video, err := fetchImportedVideo(ctx, videoUUID, sourceCID, apiKeyName)
+	if err != nil {
+		log.Error().Msgf("Unable to fetch %s from IPFS: %s\n", sourceCID, err)
+		failVideoUpload(ctx, video, videoUUID, StageFetch, err)
+		return
+	}
+
+	metadata, rejection := validateVideo(video)
+	if rejection != nil {
+		failVideoUpload(ctx, video, videoUUID, StageAnalysis, errors.New(rejection.response.Error))
+		return
+	}
+
+	videoFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
+	if rejection := reserveDisk(videoUUID, videoFolder, estimateHLSSize(metadata, profile)); rejection != nil && !shouldDelayForDisk(videoUUID) {
+		failVideoUpload(ctx, video, videoUUID, StageAnalysis, errors.New(rejection.response.Error))
+		return
+	}
+
+	if exceeded := reserveQuota(videoUUID, apiKeyName, 0, jobTranscodeMinutes(metadata, profile, nil)); exceeded != nil {
+		failVideoUpload(ctx, video, videoUUID, StageAnalysis, errors.New(exceeded.response.Error))
+		return
+	}
+
+	// From here on the job is the same as an upload, and is resumed from its source after a restart
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobQueued
+		encodingVideo.Metadata = metadata
+		encodingVideo.source = video
+	})
+
+	asyncVideoUpload(ctx, video, videoUUID, profile, metadata)
+}
+
+// Fetches the content at the CID into the scratch folder, returning the video file to transcode.
+// For a folder of HLS streams, only the highest quality variant is fetched and its segments are joined into one file.
+// The size of the content is checked against the upload limits before it is fetched, and counted towards the key's uploads.
+func fetchImportedVideo(ctx context.Context, videoUUID, sourceCID, apiKeyName string) (string, error) {
+	scratchFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder)
+
+	// Named after the job so the janitor leaves it alone while the job runs
+	importFolder := path.Join(scratchFolder, videoUUID+".import")
+	if err := os.MkdirAll(importFolder, 0755); err != nil {
+		return "", err
+	}
+	defer releaseDiskPath(videoUUID, importFolder)
+	defer os.RemoveAll(importFolder)
+
+	// Folders transcoded by dapper have a master playlist, anything else is fetched as a video file
+	masterPlaylist := path.Join(importFolder, "master.m3u8")
+	if err := ipfs.GetFile(ctx, sourceCID+"/master.m3u8", masterPlaylist, maxFetchedPlaylistSize); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		video := path.Join(scratchFolder, videoUUID+".video")
+		size, err := ipfs.FileSize(ctx, sourceCID)
+		if err != nil {
+			return "", err
+		}
+		if err := reserveFetch(videoUUID, apiKeyName, size, video); err != nil {
+			return "", err
+		}
+		return video, ipfs.GetFile(ctx, sourceCID, video, size)
+	}
+
+	variant, err := highestBandwidthVariant(masterPlaylist)
+	if err != nil {
+		return "", err
+	}
+	if err := fetchHLSFile(ctx, sourceCID, variant, importFolder, maxFetchedPlaylistSize); err != nil {
+		return "", err
+	}
+
+	segments, err := mediaPlaylistFiles(path.Join(importFolder, variant))
+	if err != nil {
+		return "", err
+	}
+
+	// Every segment is sized before any is fetched, so a stream over the limits is refused up front
+	sizes := map[string]int64{}
+	var total int64
+	for _, segment := range segments {
+		if err := checkHLSFileName(sourceCID, segment); err != nil {
+			return "", err
+		}
+		size, err := ipfs.FileSize(ctx, sourceCID+"/"+segment)
+		if err != nil {
+			return "", err
+		}
+		sizes[segment] = size
+		total += size
+	}
+
+	// The segments are joined into a file of about the same size, so room is needed for both
+	video := path.Join(scratchFolder, videoUUID+".mkv")
+	if err := reserveFetch(videoUUID, apiKeyName, total, importFolder, video); err != nil {
+		return "", err
+	}
+	for _, segment := range segments {
+		if err := fetchHLSFile(ctx, sourceCID, segment, importFolder, sizes[segment]); err != nil {
+			return "", err
+		}
+	}
+
+	return video, joinHLSStream(ctx, path.Join(importFolder, variant), video)
+}
+
+// Checks content about to be fetched from IPFS against the upload size limit,
+// then reserves room for it at each of the paths and counts it towards the key's daily uploads
+func reserveFetch(videoUUID, apiKeyName string, size int64, reservedPaths ...string) error {
+	if rejection := validateUploadSize(size); rejection != nil {
+		return errors.New(rejection.response.Error)
+	}
+	for _, reservedPath := range reservedPaths {
+		if rejection := reserveDisk(videoUUID, reservedPath, size); rejection != nil {
+			return errors.New(rejection.response.Error)
+		}
+	}
+	if exceeded := reserveQuota(videoUUID, apiKeyName, size, 0); exceeded != nil {
+		return errors.New(exceeded.response.Error)
+	}
+	return nil
+}
+
+// Fetches a file named in an HLS playlist into the import folder, failing if it is larger than maxBytes
+func fetchHLSFile(ctx context.Context, sourceCID, name, importFolder string, maxBytes int64) error {
+	if err := checkHLSFileName(sourceCID, name); err != nil {
+		return err
+	}
+
+	return ipfs.GetFile(ctx, sourceCID+"/"+name, path.Join(importFolder, name), maxBytes)
+}
+
+// Dapper writes all of a video's files into one folder, so any other path is refused rather than written outside the import folder
+func checkHLSFileName(sourceCID, name string) error {
+	if name == "" || name != path.Base(name) || strings.ContainsAny(name, `\:?`) || name == "." || name == ".." {
+		return fmt.Errorf("%s is not a folder transcoded by dapper, its playlist refers to %q", sourceCID, name)
+	}
+	return nil
+}
+
+// Copies the streams of an HLS media playlist into a single file, without re-encoding them
+func joinHLSStream(ctx context.Context, mediaPlaylist, destFile string) error {
+	cmd := exec.CommandContext(ctx, viper.GetString("ffmpeg.ffmpegDir"), "-v", "error", "-i", mediaPlaylist, "-map", "0", "-c", "copy", "-y", destFile)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + " | " + err.Error())
+	}
+
+	return nil
+}
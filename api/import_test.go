@@ -0,0 +1,19 @@
+package api
+
+import "testing"
+
+func TestCheckHLSFileName(t *testing.T) {
+	// Files dapper writes into a video folder
+	for _, name := range []string{"stream_0.m3u8", "stream_0-data00.ts", "stream_hevc-1080_init.mp4", "master.m3u8", "..m4s"} {
+		if err := checkHLSFileName("QmVideo", name); err != nil {
+			t.Errorf("checkHLSFileName(%q) failed: %s", name, err)
+		}
+	}
+
+	// Anything that could be written outside the import folder, or fetched from outside the video's folder
+	for _, name := range []string{"", ".", "..", "../stream_0.m3u8", "sub/stream_0.m3u8", "/etc/passwd", `..\stream_0.m3u8`, `C:stream_0.ts`, "stream_0.m3u8?token=1"} {
+		if err := checkHLSFileName("QmVideo", name); err == nil {
+			t.Errorf("checkHLSFileName(%q) succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// What a run of the janitor removed, given by dapper in response to "/janitor"
+type JanitorReport struct {
+	StartedAt time.Time `json:"startedAt"`
+	// Paths removed, relative to the temp video storage folder
+	Removed        []string `json:"removed"`
+	ReclaimedBytes int64    `json:"reclaimedBytes"`
+	Errors         []string `json:"errors"`
+}
+
+// Defaults used when the janitor is not configured
+const (
+	defaultJanitorInterval  = time.Hour
+	defaultJanitorOrphanAge = 24 * time.Hour
+)
+
+// The last report of the janitor, runs are serialized by the mutex
+var janitor = struct {
+	mutex      sync.Mutex
+	lastReport *JanitorReport
+}{}
+
+// Runs the janitor every `Janitor.Interval` until ctx is cancelled
+func StartJanitor(ctx context.Context) {
+	interval := viper.GetDuration("Janitor.Interval")
+	if interval <= 0 {
+		interval = defaultJanitorInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		runJanitor()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Routes
+
+// GETs
+
+// Returns the report of the last janitor run
+func getJanitorReport(c echo.Context) error {
+	janitor.mutex.Lock()
+	report := janitor.lastReport
+	janitor.mutex.Unlock()
+
+	if report == nil {
+		return c.String(http.StatusNotFound, "The janitor has not run yet")
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// POSTs
+
+// Runs the janitor now and returns what it removed
+func triggerJanitor(c echo.Context) error {
+	return c.JSON(http.StatusOK, runJanitor())
+}
+
+// Private Functions
+
+// Removes files and folders in the temp video storage folder and its scratch folder
+// that were named after a job that is not running and are older than `Janitor.OrphanAge`.
+// The temp video storage folder can be a folder the user keeps their own files in, so anything else is left alone.
+func runJanitor() JanitorReport {
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+
+	orphanAge := viper.GetDuration("Janitor.OrphanAge")
+	if orphanAge <= 0 {
+		orphanAge = defaultJanitorOrphanAge
+	}
+
+	report := JanitorReport{StartedAt: time.Now(), Removed: []string{}, Errors: []string{}}
+	cutoff := report.StartedAt.Add(-orphanAge)
+	jobIDs := runningJobIDs()
+
+	tempFolder := viper.GetString("Videos.TempVideoStorageFolder")
+	for _, folder := range []string{"", VideoScratchFolder} {
+		entries, err := os.ReadDir(path.Join(tempFolder, folder))
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		for _, entry := range entries {
+			name := path.Join(folder, entry.Name())
+			jobID, ok := jobIDFromFilename(entry.Name())
+			if !ok || jobIDs[jobID] {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+
+			orphan := path.Join(tempFolder, name)
+			size := writtenBytes(orphan)
+			if err := os.RemoveAll(orphan); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+
+			report.Removed = append(report.Removed, name)
+			report.ReclaimedBytes += size
+		}
+	}
+
+	janitorReclaimedBytesMetric.Add(float64(report.ReclaimedBytes))
+	if len(report.Removed) > 0 {
+		log.Info().Msgf("Janitor removed %d orphaned files, reclaiming %d bytes", len(report.Removed), report.ReclaimedBytes)
+	}
+	for _, err := range report.Errors {
+		log.Error().Msgf("Janitor failed: %s", err)
+	}
+
+	janitor.lastReport = &report
+	return report
+}
+
+// IDs of jobs that may still be writing to the temp video storage folder.
+// Jobs that are finished or failed no longer need their files, cancelled jobs keep their disk reservation until they stop.
+func runningJobIDs() map[string]bool {
+	ids := map[string]bool{}
+
+	EncodingVideos.mutex.Lock()
+	for id, video := range EncodingVideos.Videos {
+		if video.CurrentProgress != -1 {
+			ids[id] = true
+		}
+	}
+	EncodingVideos.mutex.Unlock()
+
+	diskReservations.mutex.Lock()
+	for id := range diskReservations.jobs {
+		ids[id] = true
+	}
+	diskReservations.mutex.Unlock()
+
+	return ids
+}
+
+// Job ID a file or folder was named after, returning false if it was not named by dapper.
+// Job files are named "<uuid>", "<uuid>.<extension>" or "<uuid>-thumbnail.<extension>", with a lowercase version 4 UUID.
+func jobIDFromFilename(name string) (string, bool) {
+	if len(name) < len(uuid.Nil.String()) {
+		return "", false
+	}
+	jobID, suffix := name[:len(uuid.Nil.String())], name[len(uuid.Nil.String()):]
+
+	id, err := uuid.Parse(jobID)
+	if err != nil || id.String() != jobID || id.Version() != 4 {
+		return "", false
+	}
+	if suffix != "" && !strings.HasPrefix(suffix, ".") && !strings.HasPrefix(suffix, "-thumbnail.") {
+		return "", false
+	}
+	return jobID, true
+}
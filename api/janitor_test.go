@@ -0,0 +1,31 @@
+package api
+
+import "testing"
+
+func TestJobIDFromFilename(t *testing.T) {
+	const id = "3b241101-e2bb-4255-8caf-4136c566a962"
+
+	named := map[string]string{
+		id:                    id,
+		id + ".mp4":           id,
+		id + ".master.m3u8":   id,
+		id + ".import":        id,
+		id + "-thumbnail.png": id,
+		id + "-import":        "",
+		id + "-thumbnail":     "",
+		"3B241101-E2BB-4255-8CAF-4136C566A962.mp4": "",
+		// Version 1 UUID
+		"6ba7b810-9dad-11d1-80b4-00c04fd430c8": "",
+		"3b241101e2bb42558caf4136c566a962.mp4": "",
+		"usage.json":                           "",
+		"scratch":                              "",
+		"":                                     "",
+	}
+
+	for name, want := range named {
+		got, ok := jobIDFromFilename(name)
+		if got != want || ok != (want != "") {
+			t.Errorf("jobIDFromFilename(%q) = %q, %v, want %q, %v", name, got, ok, want, want != "")
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gatsby-tv/dapper/types"
+	"github.com/spf13/viper"
+)
+
+// A rung of the ladder chosen for a video by the adaptive analysis pass
+type LadderRung = types.LadderRung
+
+// A sample of the source encoded by the analysis pass
+type ladderSample struct {
+	start  float64
+	length float64
+}
+
+// Quality and bitrate of the samples encoded at one CRF
+type ladderPoint struct {
+	bitRate int64
+	ssim    float64
+}
+
+// Settings of the adaptive analysis pass
+const (
+	// Samples are taken from evenly spaced points in the video
+	ladderSampleCount  = 3
+	ladderSampleLength = 4.0
+	// SSIM each rung aims for when the profile does not set one
+	defaultAdaptiveTargetSSIM = 0.98
+	// Chosen bitrates are kept within these multiples of the standard ladder's bitrates
+	adaptiveMinBitRateFactor = 0.25
+	adaptiveMaxBitRateFactor = 2.0
+	// A rung is dropped if it needs less than this multiple of the bitrate of the rung below it,
+	// since the extra resolution adds little for the content
+	adaptiveMinRungSpacing = 1.3
+)
+
+// CRFs the samples are encoded at for each codec, from lowest to highest quality
+var ladderSampleCRFs = map[string][]int{
+	CodecH264: {34, 30, 26, 22, 18},
+	CodecHEVC: {34, 30, 26, 22, 18},
+	CodecAV1:  {50, 42, 34, 26, 18},
+}
+
+// Chooses the bitrate of each rung of the standard ladder for the video, and which rungs to keep, by encoding samples of it.
+// Each rung's samples are encoded at increasing quality until they reach the profile's target SSIM,
+// and the rung's bitrate is interpolated from the last two encodes.
+// Samples are written to the work folder, which is removed when the analysis finishes.
+func analyzeLadder(ctx context.Context, videoFile, workFolder string, profile EncodingProfile, metadata *VideoMetadata) ([]LadderRung, error) {
+	videoStream := firstVideoStream(metadata)
+	if videoStream == nil {
+		return nil, errors.New("no video stream found")
+	}
+
+	if err := os.MkdirAll(workFolder, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workFolder)
+
+	targetSSIM := profile.AdaptiveTargetSSIM
+	if targetSSIM == 0 {
+		targetSSIM = defaultAdaptiveTargetSSIM
+	}
+
+	samples := ladderSamples(metadata.Duration)
+	ladder := []LadderRung{}
+	for _, rendition := range ladderRenditions(videoStream, profile) {
+		points := []ladderPoint{}
+		for _, crf := range ladderSampleCRFs[profile.Codec] {
+			point, err := measureLadderPoint(ctx, videoFile, workFolder, profile, videoStream, samples, rendition, crf)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, point)
+			if point.ssim >= targetSSIM {
+				break
+			}
+		}
+
+		standardBitRate := parseBitRate(rendition.bitRate)
+		bitRate := interpolateBitRate(points, targetSSIM)
+		if min := int64(float64(standardBitRate) * adaptiveMinBitRateFactor); bitRate < min {
+			bitRate = min
+		}
+		if max := int64(float64(standardBitRate) * adaptiveMaxBitRateFactor); bitRate > max {
+			bitRate = max
+		}
+
+		ladder = append(ladder, LadderRung{Width: rendition.width, Height: rendition.height, BitRate: fmt.Sprintf("%dk", bitRate/1000), SSIM: interpolateSSIM(points, bitRate)})
+	}
+
+	return pruneLadder(ladder), nil
+}
+
+// Returns the renditions the rungs of an adaptive ladder are transcoded to
+func ladderRungRenditions(ladder []LadderRung) []hlsRendition {
+	renditions := []hlsRendition{}
+	for _, rung := range ladder {
+		// Allow the same burst over the bitrate as the standard ladder
+		bufferSize := fmt.Sprintf("%dk", parseBitRate(rung.BitRate)*2/1000)
+		renditions = append(renditions, hlsRendition{width: rung.Width, height: rung.Height, bitRate: rung.BitRate, bufferSize: bufferSize})
+	}
+	return renditions
+}
+
+// Private Functions
+
+// Picks the samples taken from a video of the given length.
+// Videos too short to space out every sample are sampled once from the start.
+func ladderSamples(duration float64) []ladderSample {
+	if duration <= ladderSampleCount*ladderSampleLength*2 {
+		length := duration
+		if length > ladderSampleCount*ladderSampleLength {
+			length = ladderSampleCount * ladderSampleLength
+		}
+		return []ladderSample{{start: 0, length: length}}
+	}
+
+	samples := []ladderSample{}
+	for i := 1; i <= ladderSampleCount; i++ {
+		center := duration * float64(i) / float64(ladderSampleCount+1)
+		samples = append(samples, ladderSample{start: center - ladderSampleLength/2, length: ladderSampleLength})
+	}
+	return samples
+}
+
+// Encodes the samples to the rendition's resolution at the CRF, and measures their bitrate and SSIM
+func measureLadderPoint(ctx context.Context, videoFile, workFolder string, profile EncodingProfile, videoStream *StreamMetadata, samples []ladderSample, rendition hlsRendition, crf int) (ladderPoint, error) {
+	outputRange := profile.outputRange(videoStream)
+	scale := fmt.Sprintf("scale=h=%d:w=%d:force_original_aspect_ratio=increase:force_divisible_by=2", rendition.height, rendition.width)
+	sampleFile := path.Join(workFolder, fmt.Sprintf("%d_%d.mkv", rendition.height, crf))
+
+	// Encode the samples joined together, the same way the rendition is encoded but at a constant quality
+	encodeArgs := []string{"-v", "error"}
+	encodeArgs = append(encodeArgs, ladderSampleInputs(videoFile, samples)...)
+	encodeArgs = append(encodeArgs, "-filter_complex", ladderSampleFilter(0, samples, videoStream.Index, streamVideoRange(videoStream) != outputRange)+","+scale+"[v]", "-map", "[v]", "-an")
+	encodeArgs = append(encodeArgs, ladderSampleEncoderParams(profile, outputRange, crf)...)
+	encodeArgs = append(encodeArgs, "-y", sampleFile)
+
+	cmd := exec.CommandContext(ctx, viper.GetString("ffmpeg.ffmpegDir"), encodeArgs...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return ladderPoint{}, errors.New(strings.TrimSpace(string(out)) + " | " + err.Error())
+	}
+
+	info, err := os.Stat(sampleFile)
+	if err != nil {
+		return ladderPoint{}, err
+	}
+	length := 0.0
+	for _, sample := range samples {
+		length += sample.length
+	}
+
+	// Compare the encoded samples with the source samples scaled to the same resolution.
+	// Both are converted to 8-bit, which is enough to compare renditions with each other.
+	measureArgs := []string{"-hide_banner", "-nostats", "-i", sampleFile}
+	measureArgs = append(measureArgs, ladderSampleInputs(videoFile, samples)...)
+	measureArgs = append(measureArgs, "-filter_complex", "[0:v]setpts=PTS-STARTPTS,format=yuv420p[encoded]; "+ladderSampleFilter(1, samples, videoStream.Index, streamVideoRange(videoStream) != outputRange)+","+scale+",format=yuv420p[reference]; [encoded][reference]ssim", "-f", "null", "-")
+
+	cmd = exec.CommandContext(ctx, viper.GetString("ffmpeg.ffmpegDir"), measureArgs...)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return ladderPoint{}, errors.New(strings.TrimSpace(string(out)) + " | " + err.Error())
+	}
+	os.Remove(sampleFile)
+
+	ssim, err := lastScore(ssimPattern, string(out), "SSIM")
+	if err != nil {
+		return ladderPoint{}, err
+	}
+
+	return ladderPoint{bitRate: int64(float64(info.Size()) * 8 / length), ssim: ssim}, nil
+}
+
+// -ss 10 -t 4 -i video -ss 20 -t 4 -i video ...
+func ladderSampleInputs(videoFile string, samples []ladderSample) []string {
+	inputs := []string{}
+	for _, sample := range samples {
+		inputs = append(inputs, "-ss", fmt.Sprintf("%.3f", sample.start), "-t", fmt.Sprintf("%.3f", sample.length), "-i", videoFile)
+	}
+	return inputs
+}
+
+// Joins the video streams of the sample inputs starting at the given input, tone-mapping them if the rendition is
+func ladderSampleFilter(firstInput int, samples []ladderSample, videoStreamIndex int, toneMap bool) string {
+	filter := ""
+	for i := range samples {
+		filter += fmt.Sprintf("[%d:%d]", firstInput+i, videoStreamIndex)
+	}
+	filter += fmt.Sprintf("concat=n=%d:v=1:a=0,setpts=PTS-STARTPTS", len(samples))
+
+	if toneMap {
+		filter += "," + toneMapFilter
+	}
+	return filter
+}
+
+func ladderSampleEncoderParams(profile EncodingProfile, outputRange string, crf int) []string {
+	params := []string{}
+	switch profile.Codec {
+	case CodecHEVC:
+		params = append(params, "-c:v", "libx265", "-preset", "fast", "-crf", strconv.Itoa(crf), "-x265-params", "log-level=error")
+	case CodecAV1:
+		params = append(params, "-c:v", "libaom-av1", "-cpu-used", "6", "-row-mt", "1", "-crf", strconv.Itoa(crf), "-b:v", "0")
+	default:
+		params = append(params, "-c:v", "libx264", "-preset", "fast", "-crf", strconv.Itoa(crf))
+	}
+
+	if outputRange != VideoRangeSDR {
+		params = append(params, "-pix_fmt", "yuv420p10le")
+	}
+	return params
+}
+
+// Estimates the bitrate the samples reach the target SSIM at, from the last two encodes.
+// If the samples never reached the target, the bitrate of the highest quality encode is returned.
+func interpolateBitRate(points []ladderPoint, targetSSIM float64) int64 {
+	last := points[len(points)-1]
+	if len(points) == 1 || last.ssim < targetSSIM {
+		return last.bitRate
+	}
+
+	previous := points[len(points)-2]
+	if last.ssim <= previous.ssim {
+		return last.bitRate
+	}
+	fraction := (targetSSIM - previous.ssim) / (last.ssim - previous.ssim)
+	return previous.bitRate + int64(fraction*float64(last.bitRate-previous.bitRate))
+}
+
+// Estimates the SSIM of the samples at the given bitrate from the encodes on either side of it
+func interpolateSSIM(points []ladderPoint, bitRate int64) float64 {
+	lower, upper := points[0], points[len(points)-1]
+	for _, point := range points {
+		if point.bitRate <= bitRate && point.bitRate >= lower.bitRate {
+			lower = point
+		}
+		if point.bitRate >= bitRate && point.bitRate <= upper.bitRate {
+			upper = point
+		}
+	}
+
+	switch {
+	case bitRate <= lower.bitRate:
+		return lower.ssim
+	case bitRate >= upper.bitRate || upper.bitRate == lower.bitRate:
+		return upper.ssim
+	default:
+		fraction := float64(bitRate-lower.bitRate) / float64(upper.bitRate-lower.bitRate)
+		return lower.ssim + fraction*(upper.ssim-lower.ssim)
+	}
+}
+
+// Drops the rungs that need too little more bitrate than the rung below them to be worth a rendition.
+// The lowest and highest rungs are always kept, the highest taking the place of the rung below it if they are too close.
+func pruneLadder(ladder []LadderRung) []LadderRung {
+	if len(ladder) < 2 {
+		return ladder
+	}
+
+	pruned := []LadderRung{ladder[0]}
+	for i, rung := range ladder[1:] {
+		below := pruned[len(pruned)-1]
+		if float64(parseBitRate(rung.BitRate)) >= float64(parseBitRate(below.BitRate))*adaptiveMinRungSpacing {
+			pruned = append(pruned, rung)
+		} else if i == len(ladder)-2 {
+			if len(pruned) > 1 {
+				pruned = pruned[:len(pruned)-1]
+			}
+			pruned = append(pruned, rung)
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterpolateBitRate(t *testing.T) {
+	// Sample encodes of a video, from the lowest bitrate up
+	points := []ladderPoint{{bitRate: 500000, ssim: 0.93}, {bitRate: 1000000, ssim: 0.96}, {bitRate: 2000000, ssim: 0.99}}
+
+	if got := interpolateBitRate(points, 0.98); got != 1666666 {
+		t.Errorf("interpolateBitRate() between the last two encodes = %d, want 1666666", got)
+	}
+	if got := interpolateBitRate(points[:1], 0.98); got != 500000 {
+		t.Errorf("interpolateBitRate() with a single encode = %d, want 500000", got)
+	}
+	if got := interpolateBitRate(points[1:], 0.99); got != 2000000 {
+		t.Errorf("interpolateBitRate() at the last encode = %d, want 2000000", got)
+	}
+
+	// The highest bitrate is used when the target is never reached or more bits stop helping
+	if got := interpolateBitRate(points[:2], 0.98); got != 1000000 {
+		t.Errorf("interpolateBitRate() when the target is never reached = %d, want 1000000", got)
+	}
+	flat := []ladderPoint{{bitRate: 1000000, ssim: 0.99}, {bitRate: 2000000, ssim: 0.99}}
+	if got := interpolateBitRate(flat, 0.98); got != 2000000 {
+		t.Errorf("interpolateBitRate() when quality did not improve = %d, want 2000000", got)
+	}
+}
+
+func TestPruneLadder(t *testing.T) {
+	rung := func(height int64, bitRate string) LadderRung {
+		return LadderRung{Width: height * 16 / 9, Height: height, BitRate: bitRate}
+	}
+
+	tests := []struct {
+		name   string
+		ladder []LadderRung
+		want   []LadderRung
+	}{
+		{
+			name:   "empty",
+			ladder: []LadderRung{},
+			want:   []LadderRung{},
+		},
+		{
+			name:   "single rung",
+			ladder: []LadderRung{rung(240, "300k")},
+			want:   []LadderRung{rung(240, "300k")},
+		},
+		{
+			name:   "well spaced rungs are kept",
+			ladder: []LadderRung{rung(360, "400k"), rung(720, "800k"), rung(1080, "1600k")},
+			want:   []LadderRung{rung(360, "400k"), rung(720, "800k"), rung(1080, "1600k")},
+		},
+		{
+			name:   "rung too close to the one below is dropped",
+			ladder: []LadderRung{rung(360, "400k"), rung(480, "450k"), rung(1080, "1600k")},
+			want:   []LadderRung{rung(360, "400k"), rung(1080, "1600k")},
+		},
+		{
+			name:   "spacing is measured from the last kept rung",
+			ladder: []LadderRung{rung(240, "400k"), rung(360, "500k"), rung(480, "600k"), rung(1080, "1600k")},
+			want:   []LadderRung{rung(240, "400k"), rung(480, "600k"), rung(1080, "1600k")},
+		},
+		{
+			name:   "highest rung replaces the rung below it",
+			ladder: []LadderRung{rung(360, "400k"), rung(720, "1M"), rung(1080, "1100k")},
+			want:   []LadderRung{rung(360, "400k"), rung(1080, "1100k")},
+		},
+		{
+			name:   "lowest and highest rungs are always kept",
+			ladder: []LadderRung{rung(360, "400k"), rung(480, "450k")},
+			want:   []LadderRung{rung(360, "400k"), rung(480, "450k")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pruneLadder(test.ladder); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("pruneLadder() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
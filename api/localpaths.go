@@ -0,0 +1,61 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// Errors for paths on dapper's filesystem that cannot be used
+var (
+	errLocalPathsDisabled = errors.New("adding videos from dapper's filesystem is not enabled")
+	errPathNotAllowed     = errors.New("path is not inside an allowed folder")
+)
+
+// Checks that the request may name files on dapper's filesystem.
+// Keys need the local scope, and upload URLs are handed to browsers, which have no business naming files at all.
+func checkLocalPathAccess(c echo.Context) error {
+	if requestUploadToken(c) != nil {
+		return errors.New("upload URL does not allow adding videos from dapper's filesystem")
+	}
+	if key := requestAPIKey(c); key != nil && !key.hasScope(ScopeLocal) {
+		return errors.New("API key does not have the '" + ScopeLocal + "' scope")
+	}
+	return nil
+}
+
+// Resolves the given path on dapper's filesystem, following symlinks,
+// and checks that it is inside one of the folders in `Uploads.AllowedPathRoots`
+func resolveAllowedPath(file string) (string, error) {
+	roots := viper.GetStringSlice("Uploads.AllowedPathRoots")
+	if len(roots) == 0 {
+		return "", errLocalPathsDisabled
+	}
+	if !filepath.IsAbs(file) {
+		return "", fmt.Errorf("path %q is not absolute", file)
+	}
+
+	// Symlinks are resolved first, so a link inside an allowed folder cannot point outside of it
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range roots {
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+
+		relative, err := filepath.Rel(resolvedRoot, resolved)
+		if err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", errPathNotAllowed
+}
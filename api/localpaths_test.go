@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestResolveAllowedPath(t *testing.T) {
+	// The temp folder may itself be behind a symlink, so compare against resolved paths
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, outside := filepath.Join(base, "allowed"), filepath.Join(base, "outside")
+	for _, folder := range []string{filepath.Join(allowed, "sub"), outside, filepath.Join(base, "allowed-other")} {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"allowed/video.mp4", "allowed/sub/clip.mp4", "outside/secret.mp4", "allowed-other/video.mp4"} {
+		if err := os.WriteFile(filepath.Join(base, file), []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.mp4"), filepath.Join(allowed, "escape.mp4")); err != nil {
+		t.Skipf("symlinks are not supported: %s", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(allowed, filepath.Join(base, "allowed-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("Uploads.AllowedPathRoots", []string{allowed})
+	t.Cleanup(func() { viper.Set("Uploads.AllowedPathRoots", nil) })
+
+	tests := []struct {
+		name string
+		file string
+		// Path the file resolves to, relative to base, or empty if it is refused
+		want    string
+		wantErr error
+	}{
+		{name: "file in an allowed folder", file: filepath.Join(allowed, "video.mp4"), want: "allowed/video.mp4"},
+		{name: "file in a subfolder", file: filepath.Join(allowed, "sub", "clip.mp4"), want: "allowed/sub/clip.mp4"},
+		{name: "dot-dot that stays inside", file: allowed + "/sub/../video.mp4", want: "allowed/video.mp4"},
+		{name: "symlinked allowed folder", file: filepath.Join(base, "allowed-link", "video.mp4"), want: "allowed/video.mp4"},
+		{name: "dot-dot out of the folder", file: allowed + "/../outside/secret.mp4", wantErr: errPathNotAllowed},
+		{name: "symlink to a file outside", file: filepath.Join(allowed, "escape.mp4"), wantErr: errPathNotAllowed},
+		{name: "symlink to a folder outside", file: filepath.Join(allowed, "linked", "secret.mp4"), wantErr: errPathNotAllowed},
+		{name: "folder sharing the allowed folder's prefix", file: filepath.Join(base, "allowed-other", "video.mp4"), wantErr: errPathNotAllowed},
+		{name: "relative path", file: "allowed/video.mp4"},
+		{name: "missing file", file: filepath.Join(allowed, "missing.mp4")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveAllowedPath(test.file)
+			switch {
+			case test.want != "":
+				if want := filepath.Join(base, filepath.FromSlash(test.want)); err != nil || got != want {
+					t.Errorf("resolveAllowedPath(%q) = %q, %v, want %q", test.file, got, err, want)
+				}
+			case err == nil:
+				t.Errorf("resolveAllowedPath(%q) = %q, want an error", test.file, got)
+			case test.wantErr != nil && !errors.Is(err, test.wantErr):
+				t.Errorf("resolveAllowedPath(%q) error = %v, want %v", test.file, err, test.wantErr)
+			}
+		})
+	}
+
+	viper.Set("Uploads.AllowedPathRoots", nil)
+	if _, err := resolveAllowedPath(filepath.Join(allowed, "video.mp4")); !errors.Is(err, errLocalPathsDisabled) {
+		t.Errorf("resolveAllowedPath() without allowed folders error = %v, want %v", err, errLocalPathsDisabled)
+	}
+}
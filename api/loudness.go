@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gatsby-tv/dapper/types"
+	"github.com/spf13/viper"
+)
+
+// Loudness of a video's audio track measured by the first pass of ffmpeg's `loudnorm` filter
+type LoudnessMeasurement = types.LoudnessMeasurement
+
+// Default EBU R128 targets used when a profile enables normalization without setting them
+const (
+	defaultLoudnessTarget = -23.0
+	defaultTruePeak       = -1.0
+	defaultLoudnessRange  = 11.0
+)
+
+// JSON statistics printed by `loudnorm` with `print_format=json`
+type loudnormStats struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// Runs the measuring pass of `loudnorm` over the first audio stream of the given video.
+// Returns nil if the audio is silent, since silence cannot be normalized.
+func measureLoudness(videoFile string, profile EncodingProfile) (*LoudnessMeasurement, error) {
+	filter := fmt.Sprintf("loudnorm=%s:print_format=json", profile.loudnormTargets())
+	cmd := exec.Command(viper.GetString("ffmpeg.ffmpegDir"), "-hide_banner", "-nostats", "-i", videoFile, "-map", "a:0", "-af", filter, "-f", "null", "-")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.New(string(out) + " | " + err.Error())
+	}
+
+	// The statistics are the last JSON object in ffmpeg's output
+	output := string(out)
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("loudnorm did not report any statistics")
+	}
+
+	var stats loudnormStats
+	err = json.Unmarshal([]byte(output[start:end+1]), &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset}
+	parsed := make([]float64, len(values))
+	for i, value := range values {
+		parsed[i], err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loudnorm statistic %q: %s", value, err)
+		}
+		if math.IsInf(parsed[i], 0) || math.IsNaN(parsed[i]) {
+			return nil, nil
+		}
+	}
+
+	return &LoudnessMeasurement{
+		IntegratedLoudness: parsed[0],
+		TruePeak:           parsed[1],
+		LoudnessRange:      parsed[2],
+		Threshold:          parsed[3],
+		TargetOffset:       parsed[4],
+	}, nil
+}
+
+// Builds the second `loudnorm` pass, which normalizes linearly using the values from the measuring pass
+func buildLoudnormFilter(profile EncodingProfile, loudness *LoudnessMeasurement) string {
+	// loudnorm upsamples to 192kHz internally, so resample back to a rate AAC handles well
+	return fmt.Sprintf("loudnorm=%s:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true,aresample=48000",
+		profile.loudnormTargets(), loudness.IntegratedLoudness, loudness.TruePeak, loudness.LoudnessRange, loudness.Threshold, loudness.TargetOffset)
+}
+
+// Target loudness options shared by both `loudnorm` passes
+func (profile EncodingProfile) loudnormTargets() string {
+	target, truePeak, loudnessRange := defaultLoudnessTarget, defaultTruePeak, defaultLoudnessRange
+	if profile.LoudnessTarget != 0 {
+		target = profile.LoudnessTarget
+	}
+	if profile.TruePeak != nil {
+		truePeak = *profile.TruePeak
+	}
+	if profile.LoudnessRange != 0 {
+		loudnessRange = profile.LoudnessRange
+	}
+
+	return fmt.Sprintf("I=%.1f:TP=%.1f:LRA=%.1f", target, truePeak, loudnessRange)
+}
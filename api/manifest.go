@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+
+	"github.com/gatsby-tv/dapper/types"
+)
+
+// Name of the file describing the video that is pinned alongside its HLS streams
+const VideoManifestFilename = "manifest.json"
+
+// Description of a transcoded video.
+// It is pinned in the video folder so the video can be indexed without probing its streams.
+type VideoManifest struct {
+	// Metadata of the uploaded video
+	Source *VideoMetadata `json:"source"`
+	// Loudness of the uploaded audio, if it was normalized
+	Loudness *LoudnessMeasurement `json:"loudness,omitempty"`
+	// Ladder chosen for the video, if the profile analyzed it
+	Ladder []LadderRung `json:"ladder,omitempty"`
+	// Objective quality of each rendition, if it was measured
+	Quality []RenditionQuality `json:"quality,omitempty"`
+	// Title, description and thumbnail given when the video was added
+	Details *VideoDetails `json:"details,omitempty"`
+	// CID the video was imported from, if it was re-encoded from an earlier version
+	SourceCID string `json:"sourceCID,omitempty"`
+	// Renditions added with "/video/renditions" after the video was transcoded, oldest first
+	AddedRenditions []AddedRendition `json:"addedRenditions,omitempty"`
+}
+
+// A rendition added to a video that had already been published
+type AddedRendition struct {
+	// Media playlist of the rendition in the video folder
+	Playlist string `json:"playlist"`
+	Codec    string `json:"codec"`
+	Width    int64  `json:"width"`
+	Height   int64  `json:"height"`
+	BitRate  string `json:"bitRate"`
+}
+
+// Largest manifest fetched from IPFS
+const maxFetchedManifestSize = 1 << 20
+
+// Details of a video given by the caller when it is added from dapper's filesystem
+type VideoDetails = types.VideoDetails
+
+// Reads a manifest written by `writeVideoManifest`
+func readVideoManifest(manifestFile string) (VideoManifest, error) {
+	manifest := VideoManifest{}
+
+	manifestJSON, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(manifestJSON, &manifest)
+	return manifest, err
+}
+
+// Writes the manifest into the given video folder
+func writeVideoManifest(videoFolder string, manifest VideoManifest) error {
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(videoFolder, VideoManifestFilename), manifestJSON, 0644)
+}
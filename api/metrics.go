@@ -0,0 +1,136 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/gatsby-tv/dapper/ipfs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stages of a job that failures are counted by
+const (
+	StageFetch     = "fetch"
+	StageAnalysis  = "analysis"
+	StageTranscode = "transcode"
+	StageManifest  = "manifest"
+	StagePin       = "pin"
+)
+
+// Prometheus metrics exposed at "/metrics"
+var (
+	transcodeDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dapper_transcode_duration_seconds",
+		Help:    "Wall clock time taken by ffmpeg to transcode a video.",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 12),
+	}, []string{"codec"})
+
+	encodeSpeedMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dapper_encode_speed_ratio",
+		Help:    "Length of each transcoded video divided by the time taken to transcode it.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16},
+	}, []string{"codec"})
+
+	jobFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dapper_job_failures_total",
+		Help: "Jobs that failed, by the stage they failed in.",
+	}, []string{"stage"})
+
+	ipfsAddedBytesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dapper_ipfs_added_bytes_total",
+		Help: "Bytes of transcoded video added to IPFS.",
+	})
+
+	janitorReclaimedBytesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dapper_janitor_reclaimed_bytes_total",
+		Help: "Bytes of orphaned files removed by the janitor.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(transcodeDurationMetric, encodeSpeedMetric, jobFailuresMetric, ipfsAddedBytesMetric, janitorReclaimedBytesMetric, jobsCollector{}, ipfsBandwidthCollector{})
+}
+
+// Reports the number of jobs in each state from the encoding map when scraped
+type jobsCollector struct{}
+
+var (
+	jobsDesc       = prometheus.NewDesc("dapper_jobs", "Jobs known to dapper, by state.", []string{"state"}, nil)
+	queueDepthDesc = prometheus.NewDesc("dapper_queue_depth", "Jobs waiting to start transcoding.", nil, nil)
+)
+
+func (jobsCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- jobsDesc
+	descs <- queueDepthDesc
+}
+
+func (jobsCollector) Collect(metrics chan<- prometheus.Metric) {
+	states := map[string]int{}
+	for _, state := range []string{JobQueued, JobAnalyzing, JobEncoding, JobMeasuring, JobPinning, JobFinished, JobFailed} {
+		states[state] = 0
+	}
+
+	EncodingVideos.mutex.Lock()
+	for _, video := range EncodingVideos.Videos {
+		states[video.State]++
+	}
+	EncodingVideos.mutex.Unlock()
+
+	for state, count := range states {
+		metrics <- prometheus.MustNewConstMetric(jobsDesc, prometheus.GaugeValue, float64(count), state)
+	}
+	metrics <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(states[JobQueued]))
+}
+
+// Reports the bandwidth counters of the embedded IPFS node when scraped
+type ipfsBandwidthCollector struct{}
+
+var (
+	ipfsBandwidthDesc         = prometheus.NewDesc("dapper_ipfs_bandwidth_bytes_total", "Bytes transferred by the embedded IPFS node.", []string{"direction"}, nil)
+	ipfsBandwidthRateDesc     = prometheus.NewDesc("dapper_ipfs_bandwidth_rate_bytes", "Bytes per second transferred by the embedded IPFS node.", []string{"direction"}, nil)
+	ipfsProtocolBandwidthDesc = prometheus.NewDesc("dapper_ipfs_protocol_bandwidth_bytes_total", "Bytes transferred by the embedded IPFS node, by protocol.", []string{"protocol", "direction"}, nil)
+)
+
+func (ipfsBandwidthCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- ipfsBandwidthDesc
+	descs <- ipfsBandwidthRateDesc
+	descs <- ipfsProtocolBandwidthDesc
+}
+
+func (ipfsBandwidthCollector) Collect(metrics chan<- prometheus.Metric) {
+	// There are no counters when pinning with an existing IPFS node
+	if ipfs.Reporter == nil {
+		return
+	}
+
+	totals := ipfs.Reporter.GetBandwidthTotals()
+	metrics <- prometheus.MustNewConstMetric(ipfsBandwidthDesc, prometheus.CounterValue, float64(totals.TotalIn), "in")
+	metrics <- prometheus.MustNewConstMetric(ipfsBandwidthDesc, prometheus.CounterValue, float64(totals.TotalOut), "out")
+	metrics <- prometheus.MustNewConstMetric(ipfsBandwidthRateDesc, prometheus.GaugeValue, totals.RateIn, "in")
+	metrics <- prometheus.MustNewConstMetric(ipfsBandwidthRateDesc, prometheus.GaugeValue, totals.RateOut, "out")
+
+	for protocol, stats := range ipfs.Reporter.GetBandwidthByProtocol() {
+		metrics <- prometheus.MustNewConstMetric(ipfsProtocolBandwidthDesc, prometheus.CounterValue, float64(stats.TotalIn), string(protocol), "in")
+		metrics <- prometheus.MustNewConstMetric(ipfsProtocolBandwidthDesc, prometheus.CounterValue, float64(stats.TotalOut), string(protocol), "out")
+	}
+}
+
+// Records how long a video took to transcode and how fast that was relative to its length
+func observeTranscode(codec string, videoDuration, transcodeSeconds float64) {
+	transcodeDurationMetric.WithLabelValues(codec).Observe(transcodeSeconds)
+	if transcodeSeconds > 0 {
+		encodeSpeedMetric.WithLabelValues(codec).Observe(videoDuration / transcodeSeconds)
+	}
+}
+
+// Total size in bytes of the files in the given folder
+func folderSize(folder string) int64 {
+	var size int64
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gatsby-tv/dapper/ipfs"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Overview of the IPFS node and dapper's disk given by dapper in response to a GET to "/node"
+type NodeStatusResponse struct {
+	Identity  ipfs.NodeIdentity   `json:"identity"`
+	Bandwidth ipfs.BandwidthStats `json:"bandwidth"`
+	PeerCount int                 `json:"peerCount"`
+	Repo      ipfs.RepoStats      `json:"repo"`
+	Disk      DiskStatus          `json:"disk"`
+}
+
+// Routes
+
+// GETs
+
+// Returns the identity, bandwidth, peer count and repo size of the IPFS node, and the disk space reserved by jobs
+func getNodeStatus(c echo.Context) error {
+	ctx := c.Request().Context()
+	status := NodeStatusResponse{}
+
+	var err error
+	if status.Identity, err = ipfs.GetIdentity(ctx); err != nil {
+		return nodeError(c, "identity", err)
+	}
+	if status.Bandwidth, err = ipfs.GetBandwidth(ctx); err != nil {
+		return nodeError(c, "bandwidth", err)
+	}
+	peers, err := ipfs.GetPeers(ctx)
+	if err != nil {
+		return nodeError(c, "peers", err)
+	}
+	status.PeerCount = len(peers)
+	if status.Repo, err = ipfs.GetRepoStats(ctx); err != nil {
+		return nodeError(c, "repo stats", err)
+	}
+	if status.Disk, err = getDiskStatus(); err != nil {
+		log.Error().Msgf("Failed getting disk status: %s", err)
+		return c.String(http.StatusInternalServerError, "Failed getting disk status: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+// Returns the total bandwidth used by the IPFS node
+func getNodeBandwidth(c echo.Context) error {
+	bandwidth, err := ipfs.GetBandwidth(c.Request().Context())
+	if err != nil {
+		return nodeError(c, "bandwidth", err)
+	}
+	return c.JSON(http.StatusOK, bandwidth)
+}
+
+// Returns the bandwidth used by the IPFS node with each peer
+func getNodeBandwidthByPeer(c echo.Context) error {
+	bandwidth, err := ipfs.GetBandwidthByPeer(c.Request().Context())
+	if err != nil {
+		return nodeError(c, "bandwidth by peer", err)
+	}
+	return c.JSON(http.StatusOK, bandwidth)
+}
+
+// Returns the bandwidth used by the IPFS node for each protocol
+func getNodeBandwidthByProtocol(c echo.Context) error {
+	bandwidth, err := ipfs.GetBandwidthByProtocol(c.Request().Context())
+	if err != nil {
+		return nodeError(c, "bandwidth by protocol", err)
+	}
+	return c.JSON(http.StatusOK, bandwidth)
+}
+
+// Returns the peers the IPFS node is connected to
+func getNodePeers(c echo.Context) error {
+	peers, err := ipfs.GetPeers(c.Request().Context())
+	if err != nil {
+		return nodeError(c, "peers", err)
+	}
+	return c.JSON(http.StatusOK, peers)
+}
+
+// Returns the size of the IPFS node's repo
+func getNodeRepo(c echo.Context) error {
+	repo, err := ipfs.GetRepoStats(c.Request().Context())
+	if err != nil {
+		return nodeError(c, "repo stats", err)
+	}
+	return c.JSON(http.StatusOK, repo)
+}
+
+// Returns the identity of the IPFS node
+func getNodeIdentity(c echo.Context) error {
+	identity, err := ipfs.GetIdentity(c.Request().Context())
+	if err != nil {
+		return nodeError(c, "identity", err)
+	}
+	return c.JSON(http.StatusOK, identity)
+}
+
+// Returns the disk usage of the temp video storage folder and the space reserved by each job
+func getNodeDisk(c echo.Context) error {
+	disk, err := getDiskStatus()
+	if err != nil {
+		log.Error().Msgf("Failed getting disk status: %s", err)
+		return c.String(http.StatusInternalServerError, "Failed getting disk status: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, disk)
+}
+
+// Private Functions
+
+// Responds with a 502, since the IPFS node dapper pins with could not answer
+func nodeError(c echo.Context, stat string, err error) error {
+	log.Error().Msgf("Failed getting IPFS node %s: %s", stat, err)
+	return c.String(http.StatusBadGateway, "Failed getting IPFS node "+stat+": "+err.Error())
+}
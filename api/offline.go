@@ -0,0 +1,253 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Functions used by dapper's subcommands, which work on local files without the REST API
+
+// Probes the given video with ffprobe
+func ProbeVideo(videoFile string) (*VideoMetadata, error) {
+	return probeVideo(videoFile)
+}
+
+// Transcodes the video to the HLS ladder of the named encoding profile in the output folder, and writes its manifest there.
+// If onProgress is given, it is called with the percent complete while ffmpeg runs.
+func TranscodeVideo(ctx context.Context, videoFile, outputFolder, profileName string, onProgress func(progress int64)) (*VideoManifest, error) {
+	profile, err := getJobProfile(profileName, "")
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := probeVideo(videoFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed probing video: %s", err)
+	}
+	if firstVideoStream(metadata) == nil {
+		return nil, errors.New("video does not contain a video stream")
+	}
+
+	videoFrames, err := getVideoFrames(videoFile, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed counting video frames: %s", err)
+	}
+
+	var loudness *LoudnessMeasurement
+	if profile.NormalizeLoudness && firstAudioStream(metadata) != nil {
+		loudness, err = measureLoudness(videoFile, profile)
+		if err != nil {
+			return nil, fmt.Errorf("failed measuring audio loudness: %s", err)
+		}
+	}
+
+	renditions := ladderRenditions(firstVideoStream(metadata), profile)
+	var ladder []LadderRung
+	if profile.AdaptiveLadder {
+		workFolder, err := os.MkdirTemp("", "dapper-ladder")
+		if err != nil {
+			return nil, err
+		}
+		ladder, err = analyzeLadder(ctx, videoFile, workFolder, profile, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed analyzing the ladder: %s", err)
+		}
+		renditions = ladderRungRenditions(ladder)
+	}
+
+	if err := os.MkdirAll(outputFolder, 0755); err != nil {
+		return nil, err
+	}
+
+	// Progress is tracked through an entry in the encoding map, the same way it is for the daemon's jobs
+	videoUUID := uuid.New().String()
+	EncodingVideos.mutex.Lock()
+	if EncodingVideos.Videos == nil {
+		EncodingVideos.Videos = map[string]EncodingVideo{}
+	}
+	EncodingVideos.Videos[videoUUID] = EncodingVideo{State: JobEncoding, TotalFrames: videoFrames, Duration: metadata.Duration, Metadata: metadata, CreatedAt: time.Now()}
+	EncodingVideos.mutex.Unlock()
+
+	done := make(chan struct{})
+	if onProgress != nil {
+		go reportProgress(videoUUID, onProgress, done)
+	}
+
+	err = transcodeRenditionsToHLS(ctx, videoFile, outputFolder, videoUUID, profile, metadata, renditions, loudness)
+	close(done)
+
+	EncodingVideos.mutex.Lock()
+	delete(EncodingVideos.Videos, videoUUID)
+	EncodingVideos.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var quality []RenditionQuality
+	if profile.QualityMetrics {
+		quality, err = measureRenditionsQuality(ctx, videoFile, outputFolder, profile, metadata, renditions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			log.Error().Msgf("Unable to measure rendition quality: %s\n", err)
+		}
+	}
+
+	manifest := VideoManifest{Source: metadata, Loudness: loudness, Ladder: ladder, Quality: quality}
+	if err := writeVideoManifest(outputFolder, manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// Checks the values in the config file, returning every problem found
+func CheckConfig(ctx context.Context) []error {
+	problems := []error{}
+
+	if err := loadAPIKeys(); err != nil {
+		problems = append(problems, err)
+	}
+	names, secrets := map[string]bool{}, map[string]bool{}
+	for _, key := range apiKeys {
+		if key.Name == "" || key.Key == "" {
+			problems = append(problems, fmt.Errorf("API key %q must have a Name and a Key", key.Name))
+		}
+		if names[key.Name] {
+			problems = append(problems, fmt.Errorf("API key name %q is used more than once", key.Name))
+		}
+		if secrets[key.Key] {
+			problems = append(problems, fmt.Errorf("API key %q has the same Key as another key", key.Name))
+		}
+		names[key.Name], secrets[key.Key] = true, true
+
+		for _, scope := range key.Scopes {
+			switch scope {
+			case ScopeUpload, ScopeStatus, ScopeDelete, ScopeLocal, ScopeAdmin:
+			default:
+				problems = append(problems, fmt.Errorf("API key %q has unknown scope %q", key.Name, scope))
+			}
+		}
+		if key.MaxRenditionHeight < 0 {
+			problems = append(problems, fmt.Errorf("API key %q has negative MaxRenditionHeight %d", key.Name, key.MaxRenditionHeight))
+		}
+	}
+
+	if _, err := getEncodingProfile(DefaultProfileName); err != nil {
+		problems = append(problems, err)
+	}
+	for name := range viper.GetStringMap("Profiles") {
+		if _, err := getEncodingProfile(name); err != nil && name != DefaultProfileName {
+			problems = append(problems, err)
+		}
+	}
+
+	for _, key := range []string{"Uploads.MaxDuration", "Uploads.TokenMaxLifetime", "Janitor.Interval", "Janitor.OrphanAge", "Shutdown.GracePeriod", "Health.CheckTimeout", "Watch.PollInterval", "Videos.ParallelChunkLength"} {
+		if value := viper.GetString(key); value != "" {
+			if _, err := time.ParseDuration(value); err != nil {
+				problems = append(problems, fmt.Errorf("invalid %s: %s", key, err))
+			}
+		}
+	}
+
+	if value := viper.GetString("Uploads.MaxFileSize"); value != "" {
+		if _, err := parseSize(value); err != nil {
+			problems = append(problems, fmt.Errorf("invalid Uploads.MaxFileSize: %s", err))
+		}
+	}
+	if secret := viper.GetString("Uploads.TokenSecret"); secret != "" {
+		if err := validateUploadTokenSecret(secret); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if _, err := healthMinFreeSpace(); err != nil {
+		problems = append(problems, err)
+	}
+
+	if viper.IsSet("Videos.DiskHighWaterMark") {
+		if mark := viper.GetFloat64("Videos.DiskHighWaterMark"); mark <= 0 || mark > 1 {
+			problems = append(problems, fmt.Errorf("Videos.DiskHighWaterMark must be between 0 and 1, not %g", mark))
+		}
+	}
+	if height := viper.GetInt64("Videos.MaxRenditionHeight"); height < 0 {
+		problems = append(problems, fmt.Errorf("Videos.MaxRenditionHeight must not be negative, not %d", height))
+	}
+	if parallel := viper.GetInt("Videos.ParallelChunks"); parallel < 0 {
+		problems = append(problems, fmt.Errorf("Videos.ParallelChunks must not be negative, not %d", parallel))
+	}
+	switch action := viper.GetString("Videos.DiskFullAction"); action {
+	case "", DiskFullReject, DiskFullDelay:
+	default:
+		problems = append(problems, fmt.Errorf("Videos.DiskFullAction must be %q or %q, not %q", DiskFullReject, DiskFullDelay, action))
+	}
+
+	for _, key := range []string{"Uploads.PublicURL", "IPFS.ipfsURI"} {
+		if value := viper.GetString(key); value != "" {
+			if parsed, err := url.Parse(value); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				problems = append(problems, fmt.Errorf("%s must be an http or https URL, not %q", key, value))
+			}
+		}
+	}
+
+	for _, check := range []HealthCheckResult{
+		checkBinary(ctx, "ffmpeg", viper.GetString("ffmpeg.ffmpegDir")),
+		checkBinary(ctx, "ffprobe", viper.GetString("ffmpeg.ffprobeDir")),
+	} {
+		if !check.OK {
+			problems = append(problems, fmt.Errorf("%s: %s", check.Name, check.Error))
+		}
+	}
+
+	if folder := viper.GetString("Videos.TempVideoStorageFolder"); folder != "" {
+		if check := checkFolder("temp", folder, 0); !check.OK {
+			problems = append(problems, fmt.Errorf("Videos.TempVideoStorageFolder: %s", check.Error))
+		}
+	}
+
+	for _, root := range viper.GetStringSlice("Uploads.AllowedPathRoots") {
+		if info, err := os.Stat(root); err != nil || !info.IsDir() || !filepath.IsAbs(root) {
+			problems = append(problems, fmt.Errorf("Uploads.AllowedPathRoots: %q must be an absolute path to a folder", root))
+		}
+	}
+
+	if folder := viper.GetString("Watch.Folder"); folder != "" {
+		if check := checkFolder("watch", folder, 0); !check.OK {
+			problems = append(problems, fmt.Errorf("Watch.Folder: %s", check.Error))
+		}
+	}
+
+	return problems
+}
+
+// Private Functions
+
+// Calls onProgress with the progress of the video every second until done is closed
+func reportProgress(videoUUID string, onProgress func(progress int64), done chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		EncodingVideos.mutex.Lock()
+		progress := EncodingVideos.Videos[videoUUID].CurrentProgress
+		EncodingVideos.mutex.Unlock()
+
+		onProgress(progress)
+	}
+}
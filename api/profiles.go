@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Settings controlling how a video is transcoded.
+// Profiles are read from the `Profiles` table of the config file and selected by name when a video is uploaded.
+type EncodingProfile struct {
+	// Video codec used for every rendition in the ladder (h264, hevc or av1)
+	Codec string `mapstructure:"Codec" json:"codec"`
+	// How HDR sources are handled, either "tonemap" (convert to SDR BT.709) or "preserve" (keep HDR, hevc and av1 only)
+	HDR string `mapstructure:"HDR" json:"hdr"`
+	// Whether audio is normalized with a two-pass EBU R128 `loudnorm`
+	NormalizeLoudness bool `mapstructure:"NormalizeLoudness" json:"normalizeLoudness"`
+	// Integrated loudness target in LUFS (defaults to -23)
+	LoudnessTarget float64 `mapstructure:"LoudnessTarget" json:"loudnessTarget"`
+	// Maximum true peak in dBTP (defaults to -1), nil when unset since 0 is a valid target
+	TruePeak *float64 `mapstructure:"TruePeak" json:"truePeak,omitempty"`
+	// Loudness range target in LU (defaults to 11)
+	LoudnessRange float64 `mapstructure:"LoudnessRange" json:"loudnessRange"`
+	// Height of the highest rendition in the ladder (ex. 1080), 0 for the source's own resolution.
+	// Jobs are also capped by the node's Videos.MaxRenditionHeight and their API key's MaxRenditionHeight.
+	MaxRenditionHeight int64 `mapstructure:"MaxRenditionHeight" json:"maxRenditionHeight,omitempty"`
+	// Whether the bitrates and rungs of the ladder are chosen for each video by encoding samples of it at several CRFs
+	AdaptiveLadder bool `mapstructure:"AdaptiveLadder" json:"adaptiveLadder,omitempty"`
+	// SSIM each rung of an adaptive ladder aims for, against the source scaled to its resolution (defaults to 0.98)
+	AdaptiveTargetSSIM float64 `mapstructure:"AdaptiveTargetSSIM" json:"adaptiveTargetSSIM,omitempty"`
+	// Whether each rendition is scored against the source with VMAF, SSIM and PSNR after transcoding
+	QualityMetrics bool `mapstructure:"QualityMetrics" json:"qualityMetrics,omitempty"`
+}
+
+// Name of the profile used when an upload does not request one
+const DefaultProfileName = "default"
+
+// Supported values for EncodingProfile.Codec
+const (
+	CodecH264 = "h264"
+	CodecHEVC = "hevc"
+	CodecAV1  = "av1"
+)
+
+// Supported values for EncodingProfile.HDR
+const (
+	HDRToneMap  = "tonemap"
+	HDRPreserve = "preserve"
+)
+
+// Profile used when the config file does not define a default profile
+var defaultEncodingProfile = EncodingProfile{Codec: CodecH264, HDR: HDRToneMap}
+
+// Looks up the encoding profile with the given name in the config file.
+// An empty name returns the default profile.
+func getEncodingProfile(name string) (EncodingProfile, error) {
+	if name == "" {
+		name = DefaultProfileName
+	}
+
+	profiles := map[string]EncodingProfile{}
+	if err := viper.UnmarshalKey("Profiles", &profiles); err != nil {
+		return EncodingProfile{}, err
+	}
+
+	// Viper lowercases keys, so profile names are case insensitive
+	profile, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		if name != DefaultProfileName {
+			return EncodingProfile{}, fmt.Errorf("unknown encoding profile %q", name)
+		}
+		profile = defaultEncodingProfile
+	}
+
+	// Fill in unset values from the default profile
+	if profile.Codec == "" {
+		profile.Codec = defaultEncodingProfile.Codec
+	}
+	if profile.HDR == "" {
+		profile.HDR = defaultEncodingProfile.HDR
+	}
+
+	profile.Codec = strings.ToLower(profile.Codec)
+	profile.HDR = strings.ToLower(profile.HDR)
+
+	switch profile.Codec {
+	case CodecH264, CodecHEVC, CodecAV1:
+	default:
+		return EncodingProfile{}, fmt.Errorf("encoding profile %q has unsupported codec %q", name, profile.Codec)
+	}
+
+	switch profile.HDR {
+	case HDRToneMap, HDRPreserve:
+	default:
+		return EncodingProfile{}, fmt.Errorf("encoding profile %q has unsupported HDR mode %q", name, profile.HDR)
+	}
+
+	// loudnorm only accepts true peaks between -9 and 0 dBTP
+	if profile.TruePeak != nil && (*profile.TruePeak > 0 || *profile.TruePeak < -9) {
+		return EncodingProfile{}, fmt.Errorf("encoding profile %q has TruePeak %g, it must be between -9 and 0", name, *profile.TruePeak)
+	}
+	if profile.MaxRenditionHeight < 0 {
+		return EncodingProfile{}, fmt.Errorf("encoding profile %q has negative MaxRenditionHeight %d", name, profile.MaxRenditionHeight)
+	}
+	if profile.AdaptiveTargetSSIM < 0 || profile.AdaptiveTargetSSIM >= 1 {
+		return EncodingProfile{}, fmt.Errorf("encoding profile %q has AdaptiveTargetSSIM %g, it must be between 0 and 1", name, profile.AdaptiveTargetSSIM)
+	}
+
+	return profile, nil
+}
+
+// Looks up the encoding profile a job submitted with the given API key is transcoded with.
+// The profile's top rung is lowered to the node's and the key's caps, whichever is lowest.
+func getJobProfile(name, apiKeyName string) (EncodingProfile, error) {
+	profile, err := getEncodingProfile(name)
+	if err != nil {
+		return EncodingProfile{}, err
+	}
+
+	profile.MaxRenditionHeight = lowestHeightCap(profile.MaxRenditionHeight, viper.GetInt64("Videos.MaxRenditionHeight"))
+	if key := findAPIKeyByName(apiKeyName); key != nil {
+		profile.MaxRenditionHeight = lowestHeightCap(profile.MaxRenditionHeight, key.MaxRenditionHeight)
+	}
+
+	return profile, nil
+}
+
+// Whether HDR sources encoded with this profile keep their HDR signal.
+// H.264 renditions are always tone-mapped since HLS players do not support HDR H.264.
+func (profile EncodingProfile) preservesHDR() bool {
+	return profile.HDR == HDRPreserve && profile.Codec != CodecH264
+}
+
+// Dynamic range the renditions of the video stream are encoded in with this profile
+func (profile EncodingProfile) outputRange(videoStream *StreamMetadata) string {
+	if profile.preservesHDR() {
+		return streamVideoRange(videoStream)
+	}
+	return VideoRangeSDR
+}
+
+// Returns the lower of two rendition height caps, where 0 is no cap
+func lowestHeightCap(a, b int64) int64 {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gatsby-tv/dapper/types"
+	"github.com/rs/zerolog/log"
+)
+
+// Encoding telemetry reported by ffmpeg's `-progress` output
+type EncodeProgress = types.EncodeProgress
+
+// Updates the encoding map with the progress of the video encode job
+func updateEncodeFrameProgress(ffmpegStdOut io.ReadCloser, videoUUID string) {
+	readProgressBlocks(ffmpegStdOut, func(block map[string]string) {
+		EncodingVideos.update(videoUUID, func(video *EncodingVideo) {
+			video.Telemetry = parseProgressBlock(block, video.TotalFrames, video.Duration)
+			video.CurrentProgress = calculateEncodeProgress(video.Telemetry, video.TotalFrames, video.Duration, video.CurrentProgress)
+		})
+	})
+
+	// When the stdout reader is closed, ffmpeg has finished
+	// Update the encoding map to signal that the job has completed
+	finishEncodeProgress(videoUUID)
+}
+
+// Calls onBlock with each block of progress values ffmpeg writes, until its output is closed.
+// ffmpeg writes its progress as blocks of `key=value` lines, each terminated by a `progress=continue` or `progress=end` line.
+func readProgressBlocks(ffmpegStdOut io.Reader, onBlock func(block map[string]string)) {
+	scanner := bufio.NewScanner(ffmpegStdOut)
+	block := map[string]string{}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		log.Debug().Str("ffmpeg", "stdout").Msg(line)
+
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		block[keyValue[0]] = strings.TrimSpace(keyValue[1])
+
+		// Wait until the block is complete before updating the progress
+		if keyValue[0] != "progress" {
+			continue
+		}
+
+		onBlock(block)
+		block = map[string]string{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Error().Msgf("Error updating video progress: %s\n", err)
+	}
+}
+
+// Marks the encode of the video as complete in the encoding map
+func finishEncodeProgress(videoUUID string) {
+	EncodingVideos.update(videoUUID, func(video *EncodingVideo) {
+		video.CurrentProgress = 100
+		video.Telemetry.TimeRemaining = 0
+	})
+}
+
+// Converts a block of ffmpeg progress values into telemetry.
+// Values ffmpeg reports as "N/A" are left as zero.
+func parseProgressBlock(block map[string]string, totalFrames int64, duration float64) EncodeProgress {
+	progress := EncodeProgress{}
+
+	progress.Frame, _ = strconv.ParseInt(block["frame"], 10, 64)
+	progress.FPS, _ = strconv.ParseFloat(block["fps"], 64)
+	progress.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(block["speed"], "x"), 64)
+	progress.Bitrate, _ = strconv.ParseFloat(strings.TrimSuffix(block["bitrate"], "kbits/s"), 64)
+
+	if outTime, err := strconv.ParseInt(block["out_time_us"], 10, 64); err == nil && outTime > 0 {
+		progress.OutTime = float64(outTime) / 1e6
+	}
+
+	// Estimate the time remaining from the encoding speed, or from the frame rate if the duration is unknown
+	if progress.Speed > 0 && duration > 0 {
+		progress.TimeRemaining = math.Max(duration-progress.OutTime, 0) / progress.Speed
+	} else if progress.FPS > 0 && totalFrames > 0 {
+		progress.TimeRemaining = math.Max(float64(totalFrames-progress.Frame), 0) / progress.FPS
+	}
+
+	if block["progress"] == "end" {
+		progress.TimeRemaining = 0
+	}
+
+	return progress
+}
+
+// Calculates the percentage of the video that has been encoded.
+// Uses the frame count if the number of frames in the video is known, otherwise the output time.
+func calculateEncodeProgress(progress EncodeProgress, totalFrames int64, duration float64, currentProgress int64) int64 {
+	encodingProgress := currentProgress
+	if totalFrames > 0 && progress.Frame > 0 {
+		encodingProgress = int64(math.Floor(float64(progress.Frame) * 100 / float64(totalFrames)))
+	} else if duration > 0 && progress.OutTime > 0 {
+		encodingProgress = int64(math.Floor(progress.OutTime * 100 / duration))
+	}
+
+	// The estimate can overshoot near the end of the encode, 100 is only reported once ffmpeg exits
+	if encodingProgress > 99 {
+		encodingProgress = 99
+	}
+
+	return encodingProgress
+}
@@ -0,0 +1,89 @@
+package api
+
+import "testing"
+
+func TestParseProgressBlock(t *testing.T) {
+	tests := []struct {
+		name        string
+		block       map[string]string
+		totalFrames int64
+		duration    float64
+		want        EncodeProgress
+	}{
+		{
+			name:        "remaining time from speed",
+			block:       map[string]string{"frame": "240", "fps": "48.0", "speed": "2.00x", "bitrate": "1500.5kbits/s", "out_time_us": "10000000", "progress": "continue"},
+			totalFrames: 1440,
+			duration:    60,
+			want:        EncodeProgress{Frame: 240, FPS: 48, Speed: 2, Bitrate: 1500.5, OutTime: 10, TimeRemaining: 25},
+		},
+		{
+			name:        "remaining time from frame rate when the duration is unknown",
+			block:       map[string]string{"frame": "100", "fps": "25", "speed": "N/A", "bitrate": "N/A", "out_time_us": "4000000", "progress": "continue"},
+			totalFrames: 600,
+			want:        EncodeProgress{Frame: 100, FPS: 25, OutTime: 4, TimeRemaining: 20},
+		},
+		{
+			name:        "values reported as N/A are left as zero",
+			block:       map[string]string{"frame": "0", "fps": "N/A", "speed": "N/A", "bitrate": "N/A", "out_time_us": "N/A", "progress": "continue"},
+			totalFrames: 600,
+			duration:    24,
+			want:        EncodeProgress{},
+		},
+		{
+			name:     "negative output time before the first frame is ignored",
+			block:    map[string]string{"out_time_us": "-9223372036854775807", "speed": "1x", "progress": "continue"},
+			duration: 30,
+			want:     EncodeProgress{Speed: 1, TimeRemaining: 30},
+		},
+		{
+			name:        "nothing remains once ffmpeg reports the end",
+			block:       map[string]string{"frame": "1440", "fps": "48", "speed": "2x", "out_time_us": "60000000", "progress": "end"},
+			totalFrames: 1440,
+			duration:    60,
+			want:        EncodeProgress{Frame: 1440, FPS: 48, Speed: 2, OutTime: 60},
+		},
+		{
+			name:        "output past the duration does not go negative",
+			block:       map[string]string{"speed": "1x", "out_time_us": "61000000", "progress": "continue"},
+			totalFrames: 1440,
+			duration:    60,
+			want:        EncodeProgress{Speed: 1, OutTime: 61},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseProgressBlock(test.block, test.totalFrames, test.duration)
+			if got.Frame != test.want.Frame || !approxEqual(got.FPS, test.want.FPS) || !approxEqual(got.Speed, test.want.Speed) ||
+				!approxEqual(got.Bitrate, test.want.Bitrate) || !approxEqual(got.OutTime, test.want.OutTime) || !approxEqual(got.TimeRemaining, test.want.TimeRemaining) {
+				t.Errorf("parseProgressBlock() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCalculateEncodeProgress(t *testing.T) {
+	tests := []struct {
+		progress        EncodeProgress
+		totalFrames     int64
+		duration        float64
+		currentProgress int64
+		want            int64
+	}{
+		// From frames
+		{EncodeProgress{Frame: 360, OutTime: 1}, 1440, 60, 0, 25},
+		// From output time when the frames are unknown
+		{EncodeProgress{OutTime: 45}, 0, 60, 0, 75},
+		// Unchanged without frames or output time
+		{EncodeProgress{}, 1440, 60, 42, 42},
+		// Capped below 100 until ffmpeg exits
+		{EncodeProgress{Frame: 1450}, 1440, 60, 98, 99},
+	}
+
+	for _, test := range tests {
+		if got := calculateEncodeProgress(test.progress, test.totalFrames, test.duration, test.currentProgress); got != test.want {
+			t.Errorf("calculateEncodeProgress(%+v, %d, %g, %d) = %d, want %d", test.progress, test.totalFrames, test.duration, test.currentProgress, got, test.want)
+		}
+	}
+}
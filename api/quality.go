@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gatsby-tv/dapper/types"
+	"github.com/spf13/viper"
+)
+
+// Objective quality of a rendition, measured against the source after transcoding
+type RenditionQuality = types.RenditionQuality
+
+// PSNR reported for renditions identical to the source, which ffmpeg reports as infinite
+const maxPSNR = 100
+
+// Matches the scores printed by ffmpeg's `ssim`, `psnr` and `libvmaf` filters
+var (
+	ssimPattern = regexp.MustCompile(`All:([0-9.]+)`)
+	psnrPattern = regexp.MustCompile(`average:([0-9.]+|inf)`)
+	vmafPattern = regexp.MustCompile(`VMAF score[:=] ?([0-9.]+)`)
+)
+
+// Whether ffmpeg was built with libvmaf, checked the first time a video is measured
+var libvmafSupport struct {
+	once      sync.Once
+	available bool
+}
+
+// Scores each of the transcoded renditions in the video folder against the source with SSIM, PSNR and, where libvmaf is available, VMAF
+func measureRenditionsQuality(ctx context.Context, videoFile, videoFolder string, profile EncodingProfile, metadata *VideoMetadata, renditions []hlsRendition) ([]RenditionQuality, error) {
+	videoStream := firstVideoStream(metadata)
+	if videoStream == nil {
+		return nil, errors.New("no video stream found")
+	}
+
+	quality := []RenditionQuality{}
+	for i, rendition := range renditions {
+		playlist := "stream_" + rendition.streamName(i) + ".m3u8"
+
+		scores, err := measureRenditionQuality(ctx, videoFile, path.Join(videoFolder, playlist), videoStream, streamVideoRange(videoStream) != profile.outputRange(videoStream))
+		if err != nil {
+			return nil, fmt.Errorf("failed measuring %s: %s", playlist, err)
+		}
+
+		scores.Playlist = playlist
+		scores.Width, scores.Height, scores.BitRate = rendition.width, rendition.height, rendition.bitRate
+		quality = append(quality, scores)
+	}
+
+	return quality, nil
+}
+
+// Private Functions
+
+func measureRenditionQuality(ctx context.Context, videoFile, mediaPlaylist string, videoStream *StreamMetadata, toneMap bool) (RenditionQuality, error) {
+	width, height := displayResolution(videoStream)
+	vmaf := hasLibvmaf()
+
+	metrics := 2
+	if vmaf {
+		metrics++
+	}
+
+	// Both videos are compared in 8-bit, after tone-mapping the source if the rendition was
+	reference := fmt.Sprintf("[1:%d]", videoStream.Index)
+	if toneMap {
+		reference += toneMapFilter + ","
+	}
+	filter := fmt.Sprintf("[0:v:0]scale=w=%d:h=%d:flags=bicubic,format=yuv420p,setpts=PTS-STARTPTS,split=%d%s; ", width, height, metrics, splitLabels("d", metrics))
+	filter += reference + fmt.Sprintf("format=yuv420p,setpts=PTS-STARTPTS,split=%d%s; ", metrics, splitLabels("r", metrics))
+	filter += "[d0][r0]ssim; [d1][r1]psnr"
+	if vmaf {
+		filter += "; [d2][r2]libvmaf"
+	}
+
+	cmd := exec.CommandContext(ctx, viper.GetString("ffmpeg.ffmpegDir"), "-hide_banner", "-nostats", "-i", mediaPlaylist, "-i", videoFile, "-filter_complex", filter, "-f", "null", "-")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return RenditionQuality{}, errors.New(strings.TrimSpace(string(out)) + " | " + err.Error())
+	}
+	output := string(out)
+
+	quality := RenditionQuality{}
+	if quality.SSIM, err = lastScore(ssimPattern, output, "SSIM"); err != nil {
+		return RenditionQuality{}, err
+	}
+	if match := psnrPattern.FindAllStringSubmatch(output, -1); len(match) > 0 && match[len(match)-1][1] == "inf" {
+		quality.PSNR = maxPSNR
+	} else if quality.PSNR, err = lastScore(psnrPattern, output, "PSNR"); err != nil {
+		return RenditionQuality{}, err
+	}
+	if vmaf {
+		score, err := lastScore(vmafPattern, output, "VMAF")
+		if err != nil {
+			return RenditionQuality{}, err
+		}
+		quality.VMAF = &score
+	}
+
+	return quality, nil
+}
+
+// [d0][d1]...
+func splitLabels(prefix string, count int) string {
+	labels := ""
+	for i := 0; i < count; i++ {
+		labels += fmt.Sprintf("[%s%d]", prefix, i)
+	}
+	return labels
+}
+
+// Parses the last score matched by the pattern in ffmpeg's output, which is the summary printed when the filter finishes
+func lastScore(pattern *regexp.Regexp, output, name string) (float64, error) {
+	matches := pattern.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("%s was not reported", name)
+	}
+
+	score, err := strconv.ParseFloat(matches[len(matches)-1][1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", name, matches[len(matches)-1][1], err)
+	}
+	return score, nil
+}
+
+func hasLibvmaf() bool {
+	libvmafSupport.once.Do(func() {
+		out, err := exec.Command(viper.GetString("ffmpeg.ffmpegDir"), "-hide_banner", "-filters").Output()
+		libvmafSupport.available = err == nil && strings.Contains(string(out), " libvmaf ")
+	})
+	return libvmafSupport.available
+}
@@ -0,0 +1,377 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Usage of an API key and its limits, given by dapper in response to a GET to "/usage".
+// Limits of 0 are unlimited.
+type APIKeyUsageResponse struct {
+	Key                         string    `json:"key"`
+	ConcurrentJobs              int       `json:"concurrentJobs"`
+	MaxConcurrentJobs           int       `json:"maxConcurrentJobs"`
+	UploadBytesToday            int64     `json:"uploadBytesToday"`
+	MaxUploadBytesPerDay        int64     `json:"maxUploadBytesPerDay"`
+	TranscodeMinutesThisMonth   float64   `json:"transcodeMinutesThisMonth"`
+	MaxTranscodeMinutesPerMonth float64   `json:"maxTranscodeMinutesPerMonth"`
+	DayResetsAt                 time.Time `json:"dayResetsAt"`
+	MonthResetsAt               time.Time `json:"monthResetsAt"`
+}
+
+// Response given by dapper when a request is over one of its API key's limits
+type QuotaExceededResponse struct {
+	Error    string  `json:"error"`
+	Resource string  `json:"resource"`
+	Limit    float64 `json:"limit"`
+	Used     float64 `json:"used"`
+}
+
+// Limited resources
+const (
+	QuotaConcurrentJobs   = "concurrentJobs"
+	QuotaUploadBytes      = "uploadBytes"
+	QuotaTranscodeMinutes = "transcodeMinutes"
+)
+
+// Usage of an API key within the current day and month
+type keyUsage struct {
+	Day              string  `json:"day"`
+	UploadBytes      int64   `json:"uploadBytes"`
+	Month            string  `json:"month"`
+	TranscodeMinutes float64 `json:"transcodeMinutes"`
+}
+
+// Limits held by a job that has been admitted but not added to the encoding map yet
+type quotaReservation struct {
+	apiKeyName       string
+	transcodeMinutes float64
+}
+
+// A request that is over one of its key's limits
+type quotaExceeded struct {
+	response QuotaExceededResponse
+	// When the usage of the limit resets, zero if it is freed by jobs finishing
+	resetsAt time.Time
+}
+
+// Name of the file usage is saved to in the temp video storage folder, so it survives restarts
+const usageFileName = "usage.json"
+
+// Usage of every API key, keyed by name.
+// Jobs admitted but not yet in the encoding map are kept in pending, keyed by job ID, so they count towards their key's limits.
+var apiKeyUsage = struct {
+	mutex   sync.Mutex
+	keys    map[string]*keyUsage
+	pending map[string]quotaReservation
+}{keys: map[string]*keyUsage{}, pending: map[string]quotaReservation{}}
+
+// Reads the saved usage of every API key
+func loadAPIKeyUsage() error {
+	usageJSON, err := os.ReadFile(usageFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	apiKeyUsage.mutex.Lock()
+	defer apiKeyUsage.mutex.Unlock()
+
+	return json.Unmarshal(usageJSON, &apiKeyUsage.keys)
+}
+
+// Routes
+
+// GETs
+
+// Returns the usage and limits of the caller's API key.
+// Admin keys get the usage of every key, or of the key given with the `key` param.
+func getUsage(c echo.Context) error {
+	names := []string{}
+	key := requestAPIKey(c)
+	if key == nil || key.hasScope(ScopeAdmin) {
+		for _, apiKey := range apiKeys {
+			if filter := c.QueryParam("key"); filter == "" || filter == apiKey.Name {
+				names = append(names, apiKey.Name)
+			}
+		}
+	} else {
+		names = append(names, key.Name)
+	}
+	sort.Strings(names)
+
+	usage := []APIKeyUsageResponse{}
+	for _, name := range names {
+		usage = append(usage, apiKeyUsageReport(name))
+	}
+
+	return c.JSON(http.StatusOK, usage)
+}
+
+// Checks that the key can start a job that uploads and transcodes the given amounts without going over its limits
+func checkQuota(apiKeyName string, uploadBytes int64, transcodeMinutes float64) *quotaExceeded {
+	apiKeyUsage.mutex.Lock()
+	defer apiKeyUsage.mutex.Unlock()
+
+	return checkQuotaLocked(apiKeyName, "", uploadBytes, transcodeMinutes)
+}
+
+// Checks the key's limits like `checkQuota`, and if the job is allowed, counts its upload towards the key's usage
+// and holds a job slot and its transcode minutes until it finishes.
+// Jobs already in the encoding map hold their slot, so only their upload and minutes are added.
+// Jobs not in the map yet must be added with `insertJob` once the reservation is made.
+func reserveQuota(videoUUID, apiKeyName string, uploadBytes int64, transcodeMinutes float64) *quotaExceeded {
+	apiKeyUsage.mutex.Lock()
+	defer apiKeyUsage.mutex.Unlock()
+
+	if findAPIKeyByName(apiKeyName) == nil {
+		return nil
+	}
+	if exceeded := checkQuotaLocked(apiKeyName, videoUUID, uploadBytes, transcodeMinutes); exceeded != nil {
+		return exceeded
+	}
+
+	currentUsage(apiKeyName).UploadBytes += uploadBytes
+	saveAPIKeyUsage()
+
+	EncodingVideos.mutex.Lock()
+	defer EncodingVideos.mutex.Unlock()
+	if video, ok := EncodingVideos.Videos[videoUUID]; ok {
+		video.reservedMinutes += transcodeMinutes
+		EncodingVideos.Videos[videoUUID] = video
+	} else {
+		reservation := apiKeyUsage.pending[videoUUID]
+		reservation.apiKeyName = apiKeyName
+		reservation.transcodeMinutes += transcodeMinutes
+		apiKeyUsage.pending[videoUUID] = reservation
+	}
+
+	return nil
+}
+
+// Gives back what `reserveQuota` reserved for a job that was not started after all
+func releaseQuota(videoUUID, apiKeyName string, uploadBytes int64) {
+	apiKeyUsage.mutex.Lock()
+	defer apiKeyUsage.mutex.Unlock()
+
+	delete(apiKeyUsage.pending, videoUUID)
+	if findAPIKeyByName(apiKeyName) == nil {
+		return
+	}
+
+	usage := currentUsage(apiKeyName)
+	usage.UploadBytes -= uploadBytes
+	if usage.UploadBytes < 0 {
+		usage.UploadBytes = 0
+	}
+	saveAPIKeyUsage()
+}
+
+// Adds the job's entry to the encoding map, moving the limits it reserved onto the entry so they are held until it finishes
+func insertJob(videoUUID string, video EncodingVideo) {
+	apiKeyUsage.mutex.Lock()
+	defer apiKeyUsage.mutex.Unlock()
+
+	video.reservedMinutes += apiKeyUsage.pending[videoUUID].transcodeMinutes
+	delete(apiKeyUsage.pending, videoUUID)
+
+	EncodingVideos.mutex.Lock()
+	EncodingVideos.Videos[videoUUID] = video
+	EncodingVideos.mutex.Unlock()
+}
+
+// Counts the minutes a finished job transcoded towards the key's usage
+func recordTranscodeMinutes(apiKeyName string, transcodeMinutes float64) {
+	if findAPIKeyByName(apiKeyName) == nil {
+		return
+	}
+
+	apiKeyUsage.mutex.Lock()
+	defer apiKeyUsage.mutex.Unlock()
+
+	currentUsage(apiKeyName).TranscodeMinutes += transcodeMinutes
+	saveAPIKeyUsage()
+}
+
+// Minutes of transcoding a job uses, the length of the source times the number of renditions produced
+func transcodeMinutes(metadata *VideoMetadata, renditions int) float64 {
+	return metadata.Duration / 60 * float64(renditions)
+}
+
+// Minutes of transcoding a job with the profile uses, with the adaptive ladder chosen for it if there is one
+func jobTranscodeMinutes(metadata *VideoMetadata, profile EncodingProfile, ladder []LadderRung) float64 {
+	if ladder != nil {
+		return transcodeMinutes(metadata, len(ladder))
+	}
+	return transcodeMinutes(metadata, len(ladderRenditions(firstVideoStream(metadata), profile)))
+}
+
+// Rejects the request with a 429 describing the limit that was exceeded
+func (exceeded *quotaExceeded) reject(c echo.Context) error {
+	header := c.Response().Header()
+	header.Set("X-RateLimit-Resource", exceeded.response.Resource)
+	header.Set("X-RateLimit-Limit", strconv.FormatFloat(exceeded.response.Limit, 'f', -1, 64))
+	header.Set("X-RateLimit-Remaining", strconv.FormatFloat(math.Max(exceeded.response.Limit-exceeded.response.Used, 0), 'f', -1, 64))
+	if !exceeded.resetsAt.IsZero() {
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(exceeded.resetsAt.Unix(), 10))
+		header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(time.Until(exceeded.resetsAt).Seconds())), 10))
+	}
+
+	return c.JSON(http.StatusTooManyRequests, exceeded.response)
+}
+
+// Private Functions
+
+// Checks the key's limits, leaving out the job slot the given job already holds.
+// `apiKeyUsage.mutex` must be held.
+func checkQuotaLocked(apiKeyName, videoUUID string, uploadBytes int64, transcodeMinutes float64) *quotaExceeded {
+	key := findAPIKeyByName(apiKeyName)
+	if key == nil {
+		return nil
+	}
+
+	jobs, reservedMinutes := heldQuota(apiKeyName, videoUUID)
+	if key.MaxConcurrentJobs > 0 {
+		if jobs >= key.MaxConcurrentJobs {
+			return &quotaExceeded{response: QuotaExceededResponse{
+				Error:    fmt.Sprintf("API key already has %d jobs running, the limit is %d", jobs, key.MaxConcurrentJobs),
+				Resource: QuotaConcurrentJobs,
+				Limit:    float64(key.MaxConcurrentJobs),
+				Used:     float64(jobs),
+			}}
+		}
+	}
+
+	usage := currentUsage(apiKeyName)
+	dayResetsAt, monthResetsAt := usageResetTimes()
+
+	if key.maxUploadBytesPerDay > 0 && usage.UploadBytes+uploadBytes > key.maxUploadBytesPerDay {
+		return &quotaExceeded{resetsAt: dayResetsAt, response: QuotaExceededResponse{
+			Error:    fmt.Sprintf("Upload would exceed the API key's limit of %d bytes per day", key.maxUploadBytesPerDay),
+			Resource: QuotaUploadBytes,
+			Limit:    float64(key.maxUploadBytesPerDay),
+			Used:     float64(usage.UploadBytes),
+		}}
+	}
+
+	if key.MaxTranscodeMinutesPerMonth > 0 && usage.TranscodeMinutes+reservedMinutes+transcodeMinutes > key.MaxTranscodeMinutesPerMonth {
+		return &quotaExceeded{resetsAt: monthResetsAt, response: QuotaExceededResponse{
+			Error:    fmt.Sprintf("Transcoding would exceed the API key's limit of %g minutes per month", key.MaxTranscodeMinutesPerMonth),
+			Resource: QuotaTranscodeMinutes,
+			Limit:    key.MaxTranscodeMinutesPerMonth,
+			Used:     usage.TranscodeMinutes + reservedMinutes,
+		}}
+	}
+
+	return nil
+}
+
+// Builds the usage report of the given key
+func apiKeyUsageReport(apiKeyName string) APIKeyUsageResponse {
+	report := APIKeyUsageResponse{Key: apiKeyName}
+	report.DayResetsAt, report.MonthResetsAt = usageResetTimes()
+
+	if key := findAPIKeyByName(apiKeyName); key != nil {
+		report.MaxConcurrentJobs = key.MaxConcurrentJobs
+		report.MaxUploadBytesPerDay = key.maxUploadBytesPerDay
+		report.MaxTranscodeMinutesPerMonth = key.MaxTranscodeMinutesPerMonth
+	}
+
+	apiKeyUsage.mutex.Lock()
+	usage := currentUsage(apiKeyName)
+	report.UploadBytesToday = usage.UploadBytes
+	report.TranscodeMinutesThisMonth = usage.TranscodeMinutes
+	report.ConcurrentJobs, _ = heldQuota(apiKeyName, "")
+	apiKeyUsage.mutex.Unlock()
+
+	return report
+}
+
+// Returns the usage of the key, starting a new day or month if the saved one has passed.
+// `apiKeyUsage.mutex` must be held.
+func currentUsage(apiKeyName string) *keyUsage {
+	now := time.Now().UTC()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+
+	usage, ok := apiKeyUsage.keys[apiKeyName]
+	if !ok {
+		usage = &keyUsage{}
+		apiKeyUsage.keys[apiKeyName] = usage
+	}
+	if usage.Day != day {
+		usage.Day = day
+		usage.UploadBytes = 0
+	}
+	if usage.Month != month {
+		usage.Month = month
+		usage.TranscodeMinutes = 0
+	}
+
+	return usage
+}
+
+// Times the daily and monthly usage next resets, at midnight UTC
+func usageResetTimes() (day, month time.Time) {
+	now := time.Now().UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
+
+// Number of unfinished jobs created by the key, other than the given job, and the transcode minutes they hold.
+// Jobs that have been admitted but not added to the encoding map yet are counted as well.
+// `apiKeyUsage.mutex` must be held.
+func heldQuota(apiKeyName, videoUUID string) (jobs int, transcodeMinutes float64) {
+	for id, reservation := range apiKeyUsage.pending {
+		if reservation.apiKeyName == apiKeyName {
+			if id != videoUUID {
+				jobs++
+			}
+			transcodeMinutes += reservation.transcodeMinutes
+		}
+	}
+
+	EncodingVideos.mutex.Lock()
+	defer EncodingVideos.mutex.Unlock()
+
+	for id, video := range EncodingVideos.Videos {
+		if video.APIKey == apiKeyName && video.CurrentProgress != -1 {
+			if id != videoUUID {
+				jobs++
+			}
+			transcodeMinutes += video.reservedMinutes
+		}
+	}
+	return jobs, transcodeMinutes
+}
+
+// Writes the usage of every key to disk.
+// `apiKeyUsage.mutex` must be held.
+func saveAPIKeyUsage() {
+	usageJSON, err := json.Marshal(apiKeyUsage.keys)
+	if err != nil {
+		log.Error().Msgf("Failed encoding API key usage: %s", err)
+		return
+	}
+
+	if err := os.WriteFile(usageFilePath(), usageJSON, 0644); err != nil {
+		log.Error().Msgf("Failed saving API key usage: %s", err)
+	}
+}
+
+func usageFilePath() string {
+	return path.Join(viper.GetString("Videos.TempVideoStorageFolder"), usageFileName)
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Starts the test with no usage recorded for any key, saving usage to a temporary folder
+func resetAPIKeyUsage(t *testing.T) {
+	viper.Set("Videos.TempVideoStorageFolder", t.TempDir())
+	apiKeyUsage.keys, apiKeyUsage.pending = map[string]*keyUsage{}, map[string]quotaReservation{}
+	t.Cleanup(func() {
+		viper.Set("Videos.TempVideoStorageFolder", "")
+		apiKeyUsage.keys, apiKeyUsage.pending = map[string]*keyUsage{}, map[string]quotaReservation{}
+	})
+}
+
+func TestReserveQuota(t *testing.T) {
+	setAPIKeys(t, APIKey{Name: "limited", MaxConcurrentJobs: 2, maxUploadBytesPerDay: 1000, MaxTranscodeMinutesPerMonth: 60})
+	resetAPIKeyUsage(t)
+
+	// Each reservation builds on the ones before it
+	reservations := []struct {
+		job          string
+		uploadBytes  int64
+		minutes      float64
+		wantExceeded string
+	}{
+		{"job-1", 400, 20, ""},
+		{"job-2", 400, 20, ""},
+		{"job-3", 0, 0, QuotaConcurrentJobs},
+		// job-1 already holds its slot, so only its upload and minutes are checked
+		{"job-1", 300, 0, QuotaUploadBytes},
+		{"job-1", 0, 21, QuotaTranscodeMinutes},
+		// Exactly at every limit
+		{"job-1", 200, 20, ""},
+	}
+
+	for i, reservation := range reservations {
+		exceeded := reserveQuota(reservation.job, "limited", reservation.uploadBytes, reservation.minutes)
+		switch {
+		case reservation.wantExceeded == "" && exceeded != nil:
+			t.Errorf("reservation %d: reserveQuota(%s) exceeded %s, want it allowed", i, reservation.job, exceeded.response.Resource)
+		case reservation.wantExceeded != "" && (exceeded == nil || exceeded.response.Resource != reservation.wantExceeded):
+			t.Errorf("reservation %d: reserveQuota(%s) = %v, want %s exceeded", i, reservation.job, exceeded, reservation.wantExceeded)
+		}
+	}
+
+	if usage := apiKeyUsage.keys["limited"]; usage.UploadBytes != 1000 {
+		t.Errorf("key uploaded %d bytes today, want 1000", usage.UploadBytes)
+	}
+	if held := apiKeyUsage.pending["job-1"].transcodeMinutes + apiKeyUsage.pending["job-2"].transcodeMinutes; held != 60 {
+		t.Errorf("jobs hold %g transcode minutes, want 60", held)
+	}
+
+	// Keys that are not configured have no limits
+	if exceeded := reserveQuota("job-4", "unknown", 1<<40, 1e6); exceeded != nil {
+		t.Errorf("reserveQuota() for an unknown key exceeded %s", exceeded.response.Resource)
+	}
+}
+
+func TestReleaseQuota(t *testing.T) {
+	setAPIKeys(t, APIKey{Name: "limited", MaxConcurrentJobs: 1, maxUploadBytesPerDay: 1000})
+	resetAPIKeyUsage(t)
+
+	if exceeded := reserveQuota("rejected", "limited", 800, 5); exceeded != nil {
+		t.Fatalf("reserveQuota() exceeded %s", exceeded.response.Resource)
+	}
+	releaseQuota("rejected", "limited", 800)
+
+	// The slot and the upload are free for the next job
+	if exceeded := reserveQuota("next", "limited", 1000, 5); exceeded != nil {
+		t.Errorf("reserveQuota() after releaseQuota() exceeded %s", exceeded.response.Resource)
+	}
+
+	// Usage is never released below zero, such as when the day rolled over since the reservation
+	releaseQuota("next", "limited", 5000)
+	if usage := apiKeyUsage.keys["limited"]; usage.UploadBytes != 0 {
+		t.Errorf("key uploaded %d bytes today after releasing more than it uploaded, want 0", usage.UploadBytes)
+	}
+	if _, ok := apiKeyUsage.pending["next"]; ok {
+		t.Error("releaseQuota() left the job's reservation pending")
+	}
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gatsby-tv/dapper/ipfs"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Body of a POST to "/video/renditions".
+// The original source is given either by its path on dapper's filesystem or by its CID.
+type VideoRenditionsRequest struct {
+	// CID of a video transcoded by dapper to add renditions to
+	CID string `json:"cid"`
+	// Path of the original video, inside one of the folders in `Uploads.AllowedPathRoots`
+	OriginalFile string `json:"originalFile"`
+	// CID of the original video
+	OriginalCID string `json:"originalCID"`
+	// Encoding profile the added renditions are transcoded with, empty for the default profile
+	Profile string `json:"profile"`
+}
+
+// Routes
+
+// POSTs
+
+// Adds the renditions of the ladder that a published video is missing for the requested profile, such as a new codec or resolution.
+// Only the missing renditions are transcoded from the original video. They are patched into the existing folder along with
+// an updated master playlist, so the blocks of the existing renditions are reused, and the new CID is given in the job's status.
+func addRenditions(c echo.Context) error {
+	request := VideoRenditionsRequest{}
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid renditions request: "+err.Error())
+	}
+
+	request.CID = strings.TrimPrefix(request.CID, "/ipfs/")
+	if err := ipfs.ValidatePath(request.CID); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid CID: %s", err))
+	}
+
+	video := EncodingVideo{APIKey: requestAPIKeyName(c), SourceCID: request.CID, CreatedAt: time.Now(), addRenditions: true}
+	switch {
+	case (request.OriginalFile == "") == (request.OriginalCID == ""):
+		return c.String(http.StatusBadRequest, "Exactly one of originalFile and originalCID must be given")
+	case request.OriginalFile != "":
+		if err := checkLocalPathAccess(c); err != nil {
+			return c.String(http.StatusForbidden, err.Error())
+		}
+		originalFile, err := resolveAllowedPath(request.OriginalFile)
+		if err != nil {
+			return rejectLocalPath(c, "originalFile", err)
+		}
+		video.source = originalFile
+	default:
+		video.fetchCID = strings.TrimPrefix(request.OriginalCID, "/ipfs/")
+		if err := ipfs.ValidatePath(video.fetchCID); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid originalCID: %s", err))
+		}
+	}
+
+	profile, err := getJobProfile(request.Profile, video.APIKey)
+	if err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid encoding profile: %s", err))
+	}
+	video.profile = profile
+
+	// The renditions to transcode are not known until the video is analyzed, so only the job slot can be reserved now
+	videoUUID := uuid.New().String()
+	if exceeded := reserveQuota(videoUUID, video.APIKey, 0, 0); exceeded != nil {
+		return exceeded.reject(c)
+	}
+
+	startRenditionsJob(videoUUID, video)
+
+	return c.JSON(http.StatusAccepted, VideoStartEncodingResponse{ID: videoUUID})
+}
+
+// Private Functions
+
+// Adds a fetching entry for the job to the encoding map, then adds the renditions asynchronously.
+// The entry must have the CID of the existing video, the profile, and either its source or the CID to fetch it from.
+func startRenditionsJob(videoUUID string, video EncodingVideo) {
+	ctx, cancel := context.WithCancel(context.Background())
+	video.State = JobFetching
+	video.TotalFrames = 1
+	video.cancel = cancel
+
+	insertJob(videoUUID, video)
+
+	log.Info().Msgf("Adding renditions to %s as %s", video.SourceCID, videoUUID)
+	startJob(func() { asyncAddRenditions(ctx, videoUUID, video) })
+}
+
+// Transcodes the renditions the existing video is missing and patches them into its folder
+func asyncAddRenditions(ctx context.Context, videoUUID string, video EncodingVideo) {
+	var err error
+	source := video.source
+	if source == "" {
+		source, err = fetchImportedVideo(ctx, videoUUID, video.fetchCID, video.APIKey)
+		if err != nil {
+			log.Error().Msgf("Unable to fetch %s from IPFS: %s\n", video.fetchCID, err)
+			failVideoUpload(ctx, source, videoUUID, StageFetch, err)
+			return
+		}
+
+		// Jobs resumed after a restart use the fetched video rather than fetching it again
+		EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+			encodingVideo.source = source
+		})
+	}
+
+	existingPlaylist := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder, videoUUID+".master.m3u8")
+	defer os.Remove(existingPlaylist)
+	if err := ipfs.GetFile(ctx, video.SourceCID+"/master.m3u8", existingPlaylist, maxFetchedPlaylistSize); err != nil {
+		log.Error().Msgf("Unable to fetch master playlist of %s: %s\n", video.SourceCID, err)
+		failVideoUpload(ctx, source, videoUUID, StageFetch, fmt.Errorf("failed fetching master playlist of %s: %s", video.SourceCID, err))
+		return
+	}
+
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobAnalyzing
+	})
+
+	metadata, rejection := validateVideo(source)
+	if rejection != nil {
+		failVideoUpload(ctx, source, videoUUID, StageAnalysis, errors.New(rejection.response.Error))
+		return
+	}
+
+	renditions, err := missingRenditions(existingPlaylist, ladderRenditions(firstVideoStream(metadata), video.profile), video.profile)
+	if err != nil {
+		failVideoUpload(ctx, source, videoUUID, StageAnalysis, err)
+		return
+	}
+
+	// There is nothing to add, so the existing video is already the result
+	if len(renditions) == 0 {
+		log.Info().Msgf("%s already has every rendition, nothing to add", video.SourceCID)
+		if isScratchVideo(source) {
+			os.Remove(source)
+		}
+		releaseDisk(videoUUID)
+		finishRenditionsJob(videoUUID, video.SourceCID, metadata, nil, 0)
+		return
+	}
+
+	videoFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
+	if err := os.Mkdir(videoFolder, 0755); err != nil {
+		failVideoUpload(ctx, source, videoUUID, StageAnalysis, err)
+		return
+	}
+	if rejection := reserveDisk(videoUUID, videoFolder, estimateRenditionsSize(renditions, metadata.Duration)); rejection != nil {
+		if !shouldDelayForDisk(videoUUID) {
+			failVideoUpload(ctx, source, videoUUID, StageAnalysis, errors.New(rejection.response.Error))
+			return
+		}
+		if err := waitForDisk(ctx, videoUUID, videoFolder, estimateRenditionsSize(renditions, metadata.Duration)); err != nil {
+			failVideoUpload(ctx, source, videoUUID, StageAnalysis, err)
+			return
+		}
+	}
+
+	minutes := transcodeMinutes(metadata, len(renditions))
+	if exceeded := reserveQuota(videoUUID, video.APIKey, 0, minutes); exceeded != nil {
+		failVideoUpload(ctx, source, videoUUID, StageAnalysis, errors.New(exceeded.response.Error))
+		return
+	}
+
+	videoFrames, err := getVideoFrames(source, metadata)
+	if err != nil {
+		failVideoUpload(ctx, source, videoUUID, StageAnalysis, err)
+		return
+	}
+
+	var loudness *LoudnessMeasurement
+	if video.profile.NormalizeLoudness && firstAudioStream(metadata) != nil {
+		loudness, err = measureLoudness(source, video.profile)
+		if err != nil {
+			failVideoUpload(ctx, source, videoUUID, StageAnalysis, err)
+			return
+		}
+	}
+
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobEncoding
+		encodingVideo.TotalFrames = videoFrames
+		encodingVideo.Duration = metadata.Duration
+		encodingVideo.Metadata = metadata
+		encodingVideo.Loudness = loudness
+	})
+
+	err = transcodeRenditionsToHLS(ctx, source, videoFolder, videoUUID, video.profile, metadata, renditions, loudness)
+	if err != nil {
+		log.Error().Msgf("Unable to transcode renditions: %s\n", err)
+		failVideoUpload(ctx, source, videoUUID, StageTranscode, err)
+		return
+	}
+
+	// Only the added renditions are scored, the existing ones were scored when they were transcoded
+	var quality []RenditionQuality
+	if video.profile.QualityMetrics {
+		EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+			encodingVideo.State = JobMeasuring
+		})
+		quality, err = measureRenditionsQuality(ctx, source, videoFolder, video.profile, metadata, renditions)
+		if err != nil {
+			if ctx.Err() != nil {
+				failVideoUpload(ctx, source, videoUUID, StageTranscode, err)
+				return
+			}
+			log.Error().Msgf("Unable to measure rendition quality: %s\n", err)
+		}
+		EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+			encodingVideo.Quality = quality
+		})
+	}
+
+	// The master playlist lists the existing renditions followed by the added ones
+	if err := mergeMasterPlaylists(existingPlaylist, path.Join(videoFolder, "master.m3u8")); err != nil {
+		failVideoUpload(ctx, source, videoUUID, StageManifest, err)
+		return
+	}
+
+	// The manifest is patched in alongside the master playlist, so it describes the added renditions too
+	if err := updateVideoManifest(ctx, videoUUID, video, videoFolder, metadata, renditions, quality); err != nil {
+		failVideoUpload(ctx, source, videoUUID, StageManifest, err)
+		return
+	}
+
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobPinning
+	})
+	if isScratchVideo(source) {
+		os.Remove(source)
+		releaseDiskPath(videoUUID, source)
+	}
+
+	entries, err := os.ReadDir(videoFolder)
+	if err != nil {
+		failVideoUpload(ctx, "", videoUUID, StagePin, err)
+		return
+	}
+	files := map[string]string{}
+	for _, entry := range entries {
+		files[entry.Name()] = path.Join(videoFolder, entry.Name())
+	}
+
+	videoCID, err := ipfs.PatchFolder(ctx, video.SourceCID, files)
+	if err != nil {
+		log.Error().Msgf("Unable to patch renditions into %s: %s\n", video.SourceCID, err)
+		failVideoUpload(ctx, "", videoUUID, StagePin, err)
+		return
+	}
+	ipfsAddedBytesMetric.Add(float64(folderSize(videoFolder)))
+	log.Info().Msgf("Added %d renditions to %s: %s\n", len(renditions), video.SourceCID, videoCID)
+
+	if err := os.RemoveAll(videoFolder); err != nil {
+		log.Error().Msgf("Failed removing video folder: %s\n", err)
+	}
+	releaseDisk(videoUUID)
+
+	finishRenditionsJob(videoUUID, videoCID, metadata, loudness, minutes)
+}
+
+// Marks the job as finished with the CID of the patched video, and counts its transcoding time towards the key's usage
+func finishRenditionsJob(videoUUID, videoCID string, metadata *VideoMetadata, loudness *LoudnessMeasurement, minutes float64) {
+	apiKeyName := ""
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobFinished
+		encodingVideo.CID = videoCID
+		encodingVideo.CurrentProgress = -1
+		encodingVideo.Length = videoLength(metadata)
+		encodingVideo.Metadata = metadata
+		encodingVideo.Loudness = loudness
+		apiKeyName = encodingVideo.APIKey
+	})
+	recordTranscodeMinutes(apiKeyName, minutes)
+
+	log.Info().Msgf("Finished adding renditions for %s.\n", videoUUID)
+
+	notifyVideoCallback(videoUUID)
+}
+
+// Writes the manifest of the existing video into the video folder, with the added renditions and their quality scores.
+// Videos published without a manifest get a new one describing the source.
+func updateVideoManifest(ctx context.Context, videoUUID string, video EncodingVideo, videoFolder string, metadata *VideoMetadata, renditions []hlsRendition, quality []RenditionQuality) error {
+	existingManifest := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder, videoUUID+".manifest.json")
+	defer os.Remove(existingManifest)
+
+	manifest := VideoManifest{Source: metadata}
+	if err := ipfs.GetFile(ctx, video.SourceCID+"/"+VideoManifestFilename, existingManifest, maxFetchedManifestSize); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Info().Msgf("%s has no manifest, writing a new one: %s", video.SourceCID, err)
+	} else if manifest, err = readVideoManifest(existingManifest); err != nil {
+		return fmt.Errorf("invalid manifest in %s: %s", video.SourceCID, err)
+	}
+
+	for i, rendition := range renditions {
+		manifest.AddedRenditions = append(manifest.AddedRenditions, AddedRendition{
+			Playlist: "stream_" + rendition.streamName(i) + ".m3u8",
+			Codec:    video.profile.Codec,
+			Width:    rendition.width,
+			Height:   rendition.height,
+			BitRate:  rendition.bitRate,
+		})
+	}
+	manifest.Quality = append(manifest.Quality, quality...)
+
+	return writeVideoManifest(videoFolder, manifest)
+}
+
+// Returns the renditions of the ladder that the master playlist has no variant for in the profile's codec.
+// Added renditions are named after their codec and height, so their files do not clash with the existing ones.
+func missingRenditions(masterPlaylist string, ladder []hlsRendition, profile EncodingProfile) ([]hlsRendition, error) {
+	variants, err := masterPlaylistVariants(masterPlaylist)
+	if err != nil {
+		return nil, err
+	}
+	if len(variants) == 0 {
+		return nil, errors.New("existing video has no variant streams, it was not transcoded by dapper")
+	}
+
+	missing := []hlsRendition{}
+	for _, rendition := range ladder {
+		found := false
+		for _, variant := range variants {
+			// Renditions are scaled to cover the rung, so one side matches it and the other is at least as large
+			coversRung := (variant.width == rendition.width && variant.height >= rendition.height) || (variant.height == rendition.height && variant.width >= rendition.width)
+			found = found || (coversRung && variantCodec(variant) == profile.Codec)
+		}
+
+		if !found {
+			rendition.name = fmt.Sprintf("%s_%d", profile.Codec, rendition.height)
+			missing = append(missing, rendition)
+		}
+	}
+
+	return missing, nil
+}
+
+// Returns the codec of the variant's video as an encoding profile codec.
+// Variants without codecs in the master playlist are assumed to be H.264, which dapper has always transcoded to.
+func variantCodec(variant hlsVariant) string {
+	for _, codec := range variant.codecs {
+		switch {
+		case strings.HasPrefix(codec, "avc1"), strings.HasPrefix(codec, "avc3"):
+			return CodecH264
+		case strings.HasPrefix(codec, "hvc1"), strings.HasPrefix(codec, "hev1"):
+			return CodecHEVC
+		case strings.HasPrefix(codec, "av01"):
+			return CodecAV1
+		}
+	}
+	return CodecH264
+}
@@ -2,37 +2,46 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/gatsby-tv/dapper/ipfs"
+	"github.com/gatsby-tv/dapper/types"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
-// Response given by dapper to a POST to "/video".
-// Gives the caller the ID of the video within dapper to check its status and get the finished CID.
-type VideoStartEncodingResponse struct {
-	ID string `json:"id"`
+// Response given by dapper to a POST to "/video"
+type VideoStartEncodingResponse = types.VideoStartEncodingResponse
+
+// Body of a JSON POST to "/video", adding a video that is already on dapper's filesystem rather than uploading it
+type VideoPathRequest struct {
+	Title       string `json:"Title"`
+	Description string `json:"Description"`
+	// Path of the video, inside one of the folders in `Uploads.AllowedPathRoots`
+	VideoFile string `json:"VideoFile"`
+	// Path of the thumbnail, inside one of the allowed folders, empty for no thumbnail
+	ThumbnailFile string `json:"ThumbnailFile"`
+	// Encoding profile the video is transcoded with, empty for the default profile
+	Profile string `json:"Profile"`
 }
 
-// Response given by dapper to a GET to "/status".
-// Gives the caller the status of a running video encoding job.
-// If the job is complete, it returns the CID of the pinned video.
-type VideoEncodingStatusResponse struct {
-	Finished bool   `json:"finished"`
-	Progress int64  `json:"progress"`
-	CID      string `json:"cid"`
-	Length   int    `json:"length"`
-	Error    string `json:"error"`
-}
+// Response given by dapper to a GET to "/status"
+type VideoEncodingStatusResponse = types.VideoEncodingStatusResponse
+
+// Summary of an encoding job, given by dapper in response to a GET to "/videos"
+type VideoJobSummary = types.VideoJobSummary
 
 // Response given by dapper to a POST to "/thumbnail".
 // Gives the caller the CID of the thumbnail after it is added to IPFS.
@@ -44,22 +53,71 @@ type ThumbnailUploadResponse struct {
 // This folder is placed in the temp video storage folder.
 const VideoScratchFolder = "scratch"
 
-// Starts listening for requests on the given port
-func HandleRequests(port int) {
+// Loads the API keys, their usage, the upload token secret and the used upload tokens, and sets up the routes.
+// Jobs should only be resumed once this has returned, since they are charged to the loaded keys.
+func NewServer() *echo.Echo {
 	e := echo.New()
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
+	if err := loadAPIKeys(); err != nil {
+		log.Fatal().Msgf("Failed reading API keys: %s", err)
+	}
+	if len(apiKeys) == 0 {
+		log.Warn().Msg("No API keys configured, every route is open to anyone that can reach dapper")
+	}
+	if err := loadAPIKeyUsage(); err != nil {
+		log.Fatal().Msgf("Failed reading API key usage: %s", err)
+	}
+	if err := loadUploadTokenSecret(); err != nil {
+		log.Fatal().Msgf("Failed setting up upload token secret: %s", err)
+	}
+	if err := loadUsedUploadTokens(); err != nil {
+		log.Fatal().Msgf("Failed reading used upload tokens: %s", err)
+	}
+
+	// Allow browsers on the configured origins to upload directly with upload URLs
+	if allowedOrigins := viper.GetStringSlice("Uploads.AllowedOrigins"); len(allowedOrigins) > 0 {
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{AllowOrigins: allowedOrigins, AllowMethods: []string{http.MethodPost}}))
+	}
+
 	// GETs
-	// e.GET("/traffic", getCurrentOutTraffic)
-	e.GET("/status", encodingStatus)
+	e.GET("/healthz", liveness)
+	e.GET("/readyz", readiness)
+	e.GET("/status", encodingStatus, requireScope(ScopeStatus))
+	e.GET("/videos", listVideos, requireScope(ScopeStatus))
+	e.GET("/usage", getUsage, requireScope(ScopeStatus))
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()), requireScope(ScopeAdmin))
+	e.GET("/node", getNodeStatus, requireScope(ScopeAdmin))
+	e.GET("/node/bandwidth", getNodeBandwidth, requireScope(ScopeAdmin))
+	e.GET("/node/bandwidth/peers", getNodeBandwidthByPeer, requireScope(ScopeAdmin))
+	e.GET("/node/bandwidth/protocols", getNodeBandwidthByProtocol, requireScope(ScopeAdmin))
+	e.GET("/node/peers", getNodePeers, requireScope(ScopeAdmin))
+	e.GET("/node/repo", getNodeRepo, requireScope(ScopeAdmin))
+	e.GET("/node/id", getNodeIdentity, requireScope(ScopeAdmin))
+	e.GET("/node/disk", getNodeDisk, requireScope(ScopeAdmin))
+	e.GET("/janitor", getJanitorReport, requireScope(ScopeAdmin))
 
 	// POSTs
-	e.POST("/video", uploadVideo)
-	e.POST("/thumbnail", uploadThumbnail)
+	e.POST("/video", uploadVideo, rejectWhileShuttingDown, requireScopeOrUploadToken(ScopeUpload))
+	e.POST("/video/import", importVideo, rejectWhileShuttingDown, requireScope(ScopeUpload))
+	e.POST("/video/renditions", addRenditions, rejectWhileShuttingDown, requireScope(ScopeUpload))
+	e.POST("/upload-url", issueUploadURL, rejectWhileShuttingDown, requireScope(ScopeUpload))
+	e.POST("/thumbnail", uploadThumbnail, rejectWhileShuttingDown, requireScope(ScopeUpload))
+	e.POST("/janitor", triggerJanitor, requireScope(ScopeAdmin))
 
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", port)))
+	// DELETEs
+	e.DELETE("/video", deleteVideo, requireScope(ScopeDelete))
+
+	return e
+}
+
+// Starts listening for requests on the given port, until the server is shut down
+func HandleRequests(e *echo.Echo, port int) {
+	if err := e.Start(fmt.Sprintf(":%d", port)); err != nil && err != http.ErrServerClosed {
+		log.Fatal().Msgf("Failed listening for requests: %s", err)
+	}
 }
 
 // Routes
@@ -78,22 +136,22 @@ func encodingStatus(c echo.Context) error {
 
 	EncodingVideos.mutex.Lock()
 
-	// Check that the video is in the encoding map
-	if progress, ok := EncodingVideos.Videos[keys]; ok {
+	// Check that the video is in the encoding map and belongs to the caller
+	if progress, ok := EncodingVideos.Videos[keys]; ok && canAccessJob(c, progress.APIKey) {
 		// Check if the encode has finished
 		if progress.CurrentProgress == -1 {
 			if progress.Error != nil {
-				statusResponse := VideoEncodingStatusResponse{Finished: true, Error: progress.Error.Error()}
+				statusResponse := VideoEncodingStatusResponse{State: progress.State, Finished: true, SourceCID: progress.SourceCID, Error: progress.Error.Error()}
 				response = c.JSON(http.StatusInternalServerError, statusResponse)
 			} else {
-				statusResponse := VideoEncodingStatusResponse{Finished: true, CID: progress.CID, Length: progress.Length}
+				statusResponse := VideoEncodingStatusResponse{State: progress.State, Finished: true, CID: progress.CID, Length: progress.Length, Loudness: progress.Loudness, Ladder: progress.Ladder, Quality: progress.Quality, Metadata: progress.Metadata, Details: progress.Details, SourceCID: progress.SourceCID}
 
 				response = c.JSON(http.StatusCreated, statusResponse)
 			}
 
 			delete(EncodingVideos.Videos, keys)
 		} else {
-			statusResponse := VideoEncodingStatusResponse{Finished: false, Progress: progress.CurrentProgress}
+			statusResponse := VideoEncodingStatusResponse{State: progress.State, Finished: false, Progress: progress.CurrentProgress, Encoding: &progress.Telemetry, Metadata: progress.Metadata, Details: progress.Details, SourceCID: progress.SourceCID}
 
 			response = c.JSON(http.StatusAccepted, statusResponse)
 		}
@@ -103,46 +161,227 @@ func encodingStatus(c echo.Context) error {
 
 	EncodingVideos.mutex.Unlock()
 
-	log.Trace().Msgf("Returning status for %s", keys[0])
+	log.Trace().Msgf("Returning status for %s", keys)
 
 	return response
 }
 
-// func getCurrentOutTraffic(w http.ResponseWriter, r *http.Request) {
-// 	fmt.Fprintf(w, "%s/s", humanize.Bytes(uint64(Reporter.GetBandwidthTotals().RateOut)))
-// }
+// Lists the encoding jobs dapper knows about.
+// Admin keys see every job and can filter by key with the `key` param, other keys only see their own jobs.
+func listVideos(c echo.Context) error {
+	keyFilter := c.QueryParam("key")
+	if key := requestAPIKey(c); key != nil && !key.hasScope(ScopeAdmin) {
+		keyFilter = key.Name
+	}
+
+	EncodingVideos.mutex.Lock()
+	videos := []VideoJobSummary{}
+	for id, video := range EncodingVideos.Videos {
+		if keyFilter != "" && video.APIKey != keyFilter {
+			continue
+		}
+
+		summary := VideoJobSummary{ID: id, State: video.State, Finished: video.CurrentProgress == -1, Progress: video.CurrentProgress, CID: video.CID, SourceCID: video.SourceCID, APIKey: video.APIKey, CreatedAt: video.CreatedAt}
+		if video.Error != nil {
+			summary.Error = video.Error.Error()
+		}
+		videos = append(videos, summary)
+	}
+	EncodingVideos.mutex.Unlock()
+
+	sort.Slice(videos, func(i, j int) bool { return videos[i].CreatedAt.Before(videos[j].CreatedAt) })
+
+	return c.JSON(http.StatusOK, videos)
+}
 
 // POSTs
 
 // Take video and thumbnail from multipart form data, transfer it to the disk, convert it to HLS, then pin it with IPFS.
+// The request is authorized either by an API key or by an upload token, whose constraints are enforced here.
 func uploadVideo(c echo.Context) error {
-	// Check for the necessary files in the multipart form data
-	videoHeader, err := c.FormFile("video")
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return addVideoFromPath(c)
+	}
+
+	// Reject videos over the size limit before they are written to disk
+	sizeLimit := uploadSizeLimit(requestUploadToken(c))
+	body, rejection := limitUploadBody(c.Request(), sizeLimit)
+	if rejection != nil {
+		return c.JSON(rejection.status, rejection.response)
+	}
+
+	// Reserve room for the video from the upload's Content-Length, or the most it is allowed to be,
+	// and write it from the multipart form data straight to the scratch folder
+	videoUUID := uuid.New().String()
+	reservedSize := c.Request().ContentLength
+	if reservedSize < 0 {
+		reservedSize = sizeLimit
+	}
+	form, rejection, err := readUploadForm(c.Request(), videoUUID, reservedSize)
+	queued := false
+	defer func() {
+		if !queued {
+			os.Remove(form.videoFile)
+			releaseDisk(videoUUID)
+		}
+	}()
+	if rejection != nil {
+		log.Info().Msgf("Rejected upload of %d bytes: %s", reservedSize, rejection.response.Error)
+		return c.JSON(rejection.status, rejection.response)
+	}
 	if err != nil {
+		if body != nil && body.exceeded {
+			return c.JSON(http.StatusRequestEntityTooLarge, VideoRejectedResponse{Reason: RejectFileTooLarge, Error: fmt.Sprintf("upload is over the limit of %d bytes", sizeLimit)})
+		}
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Failed getting video from multipart form data: %s", err))
 	}
 
-	video, err := videoHeader.Open()
+	// The body limit allows for the rest of the form, so check the video itself
+	if rejection := validateUploadSize(form.size); rejection != nil {
+		return c.JSON(rejection.status, rejection.response)
+	}
+
+	profileName := form.profile
+	apiKeyName := requestAPIKeyName(c)
+	callbackURL := ""
+	if token := requestUploadToken(c); token != nil {
+		if token.MaxSize > 0 && form.size > token.MaxSize {
+			return c.JSON(http.StatusRequestEntityTooLarge, VideoRejectedResponse{Reason: RejectFileTooLarge, Error: fmt.Sprintf("video is %d bytes, the upload URL allows %d bytes", form.size, token.MaxSize)})
+		}
+		if profileName != "" && profileName != token.Profile {
+			return c.String(http.StatusForbidden, "Upload URL does not allow the requested encoding profile")
+		}
+
+		// Hold the token while the upload is checked so no other request can use it,
+		// and release it if the upload is rejected so it can be retried
+		if !useUploadToken(token) {
+			return c.String(http.StatusUnauthorized, "Upload URL has already been used")
+		}
+		defer func() {
+			if !queued {
+				releaseUploadToken(token)
+			}
+		}()
+
+		profileName = token.Profile
+		apiKeyName = token.APIKey
+		callbackURL = token.CallbackURL
+	}
+
+	// Check the key's limits before transcoding the video
+	if exceeded := checkQuota(apiKeyName, form.size, 0); exceeded != nil {
+		return exceeded.reject(c)
+	}
+
+	// Look up the requested encoding profile before accepting the upload
+	profile, err := getJobProfile(profileName, apiKeyName)
 	if err != nil {
-		return c.String(http.StatusBadRequest, fmt.Sprintf("Failed opening video from multipart form data: %s", err))
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid encoding profile: %s", err))
 	}
-	defer video.Close()
 
-	// Write video to disk
-	videoUUID := uuid.New().String()
+	// Make sure the video can be transcoded before queuing it
+	metadata, rejection := validateVideo(form.videoFile)
+	if rejection != nil {
+		log.Info().Msgf("Rejected video %s: %s", form.filename, rejection.response.Error)
+		return c.JSON(rejection.status, rejection.response)
+	}
+
+	// Reserve room for the transcoded video, or wait for other jobs to free it if configured to
+	videoFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
+	if rejection := reserveDisk(videoUUID, videoFolder, estimateHLSSize(metadata, profile)); rejection != nil {
+		if !shouldDelayForDisk(videoUUID) {
+			log.Info().Msgf("Rejected video %s: %s", form.filename, rejection.response.Error)
+			return c.JSON(rejection.status, rejection.response)
+		}
+		log.Info().Msgf("Delaying video %s until there is disk space: %s", form.filename, rejection.response.Error)
+	}
+
+	// Now that the length of the video is known, make sure the key has enough transcoding time left, and hold its job slot
+	if exceeded := reserveQuota(videoUUID, apiKeyName, form.size, jobTranscodeMinutes(metadata, profile, nil)); exceeded != nil {
+		return exceeded.reject(c)
+	}
+
+	log.Trace().Msgf("Finished video pre-processing. Starting encoding of %s", form.videoFile)
+
+	// Create entry for video in the global map and run rest of video upload async
+	startVideoJob(videoUUID, EncodingVideo{Metadata: metadata, APIKey: apiKeyName, CallbackURL: callbackURL, source: form.videoFile, profile: profile})
+	queued = true
+
+	return c.JSON(http.StatusAccepted, VideoStartEncodingResponse{ID: videoUUID})
+}
+
+// Add a video that is already on dapper's filesystem, given by the JSON body of a POST to "/video".
+// The video is transcoded where it is and left in place, rather than being copied into the scratch folder.
+func addVideoFromPath(c echo.Context) error {
+	if err := checkLocalPathAccess(c); err != nil {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+
+	request := VideoPathRequest{}
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid video request: "+err.Error())
+	}
 
-	videoFilename := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder, videoUUID+"."+strings.Split(videoHeader.Filename, ".")[len(strings.Split(videoHeader.Filename, "."))-1])
+	videoFile, err := resolveAllowedPath(request.VideoFile)
+	if err != nil {
+		return rejectLocalPath(c, "VideoFile", err)
+	}
+	thumbnailFile := ""
+	if request.ThumbnailFile != "" {
+		if thumbnailFile, err = resolveAllowedPath(request.ThumbnailFile); err != nil {
+			return rejectLocalPath(c, "ThumbnailFile", err)
+		}
+	}
 
-	err = writeMultiPartFormDataToDisk(video, videoFilename)
+	apiKeyName := requestAPIKeyName(c)
+	profile, err := getJobProfile(request.Profile, apiKeyName)
 	if err != nil {
-		log.Error().Msgf("Failed writing video to disk: %s", err)
-		return c.String(http.StatusInternalServerError, "Failed writing video to disk: %s")
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid encoding profile: %s", err))
+	}
+
+	// Make sure the video can be transcoded before queuing it
+	metadata, rejection := validateVideo(videoFile)
+	if rejection != nil {
+		log.Info().Msgf("Rejected video %s: %s", videoFile, rejection.response.Error)
+		return c.JSON(rejection.status, rejection.response)
+	}
+
+	if exceeded := checkQuota(apiKeyName, metadata.Size, 0); exceeded != nil {
+		return exceeded.reject(c)
+	}
+
+	// The video is already on disk, so only room for the transcoded video is needed
+	videoUUID := uuid.New().String()
+	videoFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
+	if rejection := reserveDisk(videoUUID, videoFolder, estimateHLSSize(metadata, profile)); rejection != nil {
+		if !shouldDelayForDisk(videoUUID) {
+			log.Info().Msgf("Rejected video %s: %s", videoFile, rejection.response.Error)
+			releaseDisk(videoUUID)
+			return c.JSON(rejection.status, rejection.response)
+		}
+		log.Info().Msgf("Delaying video %s until there is disk space: %s", videoFile, rejection.response.Error)
+	}
+
+	if exceeded := reserveQuota(videoUUID, apiKeyName, metadata.Size, jobTranscodeMinutes(metadata, profile, nil)); exceeded != nil {
+		releaseDisk(videoUUID)
+		return exceeded.reject(c)
+	}
+
+	// The thumbnail is only added once the job is admitted, so rejected requests leave nothing in IPFS
+	details := &VideoDetails{Title: request.Title, Description: request.Description}
+	if thumbnailFile != "" {
+		details.Thumbnail, err = ipfs.AddFileToIPFS(c.Request().Context(), thumbnailFile)
+		if err != nil {
+			log.Error().Msgf("Failed adding thumbnail to IPFS: %s", err)
+			releaseQuota(videoUUID, apiKeyName, metadata.Size)
+			releaseDisk(videoUUID)
+			return c.String(http.StatusInternalServerError, "Failed adding thumbnail to IPFS")
+		}
 	}
 
-	log.Trace().Msgf("Finished video pre-processing. Starting encoding of %s", videoFilename)
+	log.Trace().Msgf("Finished video pre-processing. Starting encoding of %s", videoFile)
 
-	// Run rest of video upload async
-	go asyncVideoUpload(videoFilename, videoUUID)
+	startVideoJob(videoUUID, EncodingVideo{Metadata: metadata, Details: details, APIKey: apiKeyName, source: videoFile, profile: profile})
 
 	return c.JSON(http.StatusAccepted, VideoStartEncodingResponse{ID: videoUUID})
 }
@@ -163,7 +402,7 @@ func uploadThumbnail(c echo.Context) error {
 	// Write thumbnail to disk
 	thumbnailFilename := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder, uuid.New().String()+"-thumbnail"+"."+strings.Split(thumbnailHeader.Filename, ".")[len(strings.Split(thumbnailHeader.Filename, "."))-1])
 
-	err = writeMultiPartFormDataToDisk(thumbnail, thumbnailFilename)
+	_, err = writeMultiPartFormDataToDisk(thumbnail, thumbnailFilename)
 	if err != nil {
 		log.Error().Msgf("Failed writing thumbnail to disk: %s", err)
 		return c.String(http.StatusInternalServerError, "Failed writing thumbnail to disk")
@@ -181,65 +420,182 @@ func uploadThumbnail(c echo.Context) error {
 	return c.JSON(http.StatusCreated, ThumbnailUploadResponse{CID: thumbnailCID})
 }
 
-// Private Functions
+// DELETEs
+
+// Cancels the encoding job if it is still running and removes it from dapper
+func deleteVideo(c echo.Context) error {
+	id := c.QueryParam("id")
 
-// Transcode and pin video asynchronously while dapper continues to listen for requests
-func asyncVideoUpload(video, videoUUID string) {
-	ctx := context.Background()
-	defer ctx.Done()
+	// Check that the id param was given
+	if len(id) < 1 {
+		return c.String(http.StatusBadRequest, "Param 'id' is missing")
+	}
 
-	// Create entry for video in the global map
 	EncodingVideos.mutex.Lock()
-	EncodingVideos.Videos[videoUUID] = EncodingVideo{TotalFrames: 1, CurrentProgress: 0}
-	EncodingVideos.mutex.Unlock()
+	defer EncodingVideos.mutex.Unlock()
 
-	// Get the length of the video in seconds
-	videoLength, err := getVideoLength(video)
-	if err != nil {
-		log.Error().Msgf("Unable to get video length: %s\n", err)
-		EncodingVideos.mutex.Lock()
-		EncodingVideos.Videos[videoUUID] = EncodingVideo{Error: err, CurrentProgress: -1}
-		EncodingVideos.mutex.Unlock()
-		return
+	video, ok := EncodingVideos.Videos[id]
+	if !ok || !canAccessJob(c, video.APIKey) {
+		return c.String(http.StatusNotFound, "Specified ID is not transcoding.")
+	}
+
+	// Stop ffmpeg and any pinning in progress
+	if video.cancel != nil {
+		video.cancel()
+	}
+	delete(EncodingVideos.Videos, id)
+
+	log.Info().Msgf("Deleted video job %s", id)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Private Functions
+
+// Adds a queued entry for the video to the encoding map, so its status is available as soon as its ID is returned,
+// then transcodes and pins its source asynchronously.
+// The entry must have its source, profile and metadata set.
+func startVideoJob(videoUUID string, video EncodingVideo) {
+	ctx, cancel := context.WithCancel(context.Background())
+	video.State = JobQueued
+	video.TotalFrames = 1
+	video.CreatedAt = time.Now()
+	video.cancel = cancel
+
+	insertJob(videoUUID, video)
+
+	startJob(func() { asyncVideoUpload(ctx, video.source, videoUUID, video.profile, video.Metadata) })
+}
+
+// Transcode and pin video asynchronously while dapper continues to listen for requests.
+// The video's entry in the encoding map must already exist, cancelling ctx stops the job.
+func asyncVideoUpload(ctx context.Context, video, videoUUID string, profile EncodingProfile, metadata *VideoMetadata) {
+	// Jobs admitted without room for their output stay queued until other jobs free it
+	videoFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
+	if !diskReserved(videoUUID, videoFolder) {
+		if err := waitForDisk(ctx, videoUUID, videoFolder, estimateHLSSize(metadata, profile)); err != nil {
+			failVideoUpload(ctx, video, videoUUID, StageAnalysis, err)
+			return
+		}
 	}
 
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobAnalyzing
+	})
+
 	// Get the number of frames in the video for tracking encoding progress
-	videoFrames, err := getVideoFrames(video, videoLength)
+	videoFrames, err := getVideoFrames(video, metadata)
 	if err != nil {
 		log.Error().Msgf("Unable to count video frames: %s\n", err)
-		EncodingVideos.mutex.Lock()
-		EncodingVideos.Videos[videoUUID] = EncodingVideo{Error: err, CurrentProgress: -1}
-		EncodingVideos.mutex.Unlock()
+		failVideoUpload(ctx, video, videoUUID, StageAnalysis, err)
 		return
 	}
 
+	// Measure the loudness of the audio for the normalization pass
+	var loudness *LoudnessMeasurement
+	if profile.NormalizeLoudness && firstAudioStream(metadata) != nil {
+		loudness, err = measureLoudness(video, profile)
+		if err != nil {
+			log.Error().Msgf("Unable to measure audio loudness: %s\n", err)
+			failVideoUpload(ctx, video, videoUUID, StageAnalysis, err)
+			return
+		}
+	}
+
+	// Choose the ladder for the video's content, if the profile asks for it.
+	// Jobs resumed after a restart keep the ladder they chose before, rather than analyzing the video again.
+	renditions := ladderRenditions(firstVideoStream(metadata), profile)
+	var ladder []LadderRung
+	if profile.AdaptiveLadder {
+		EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+			ladder = encodingVideo.Ladder
+		})
+		if ladder == nil {
+			// Named after the job so the janitor leaves it alone while the job runs
+			workFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder, videoUUID+".ladder")
+			ladder, err = analyzeLadder(ctx, video, workFolder, profile, metadata)
+			if err != nil {
+				log.Error().Msgf("Unable to analyze the ladder: %s\n", err)
+				failVideoUpload(ctx, video, videoUUID, StageAnalysis, err)
+				return
+			}
+		}
+		renditions = ladderRungRenditions(ladder)
+	}
+
 	// Update the global map with the total number of frames in the current video
-	EncodingVideos.mutex.Lock()
-	EncodingVideos.Videos[videoUUID] = EncodingVideo{TotalFrames: videoFrames, CurrentProgress: 0}
-	EncodingVideos.mutex.Unlock()
+	var details *VideoDetails
+	sourceCID := ""
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobEncoding
+		encodingVideo.TotalFrames = videoFrames
+		encodingVideo.Duration = metadata.Duration
+		encodingVideo.Metadata = metadata
+		encodingVideo.Loudness = loudness
+		encodingVideo.Ladder = ladder
+		details = encodingVideo.Details
+		sourceCID = encodingVideo.SourceCID
+	})
 
 	// Convert video to HLS pieces
-	videoFolder, err := convertToHLS(video, videoUUID)
+	videoFolder, err = convertToHLS(ctx, video, videoUUID, profile, metadata, renditions, loudness)
 	if err != nil {
 		log.Error().Msgf("Unable to convert video to HLS: %s\n", err)
-		EncodingVideos.mutex.Lock()
-		EncodingVideos.Videos[videoUUID] = EncodingVideo{Error: err, CurrentProgress: -1}
-		EncodingVideos.mutex.Unlock()
+		failVideoUpload(ctx, video, videoUUID, StageTranscode, err)
+		return
+	}
+
+	// Score the renditions against the source, if the profile asks for it
+	var quality []RenditionQuality
+	if profile.QualityMetrics {
+		EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+			encodingVideo.State = JobMeasuring
+		})
+		quality, err = measureRenditionsQuality(ctx, video, videoFolder, profile, metadata, renditions)
+		if err != nil {
+			if ctx.Err() != nil {
+				failVideoUpload(ctx, video, videoUUID, StageTranscode, err)
+				return
+			}
+			// The scores are only informational, so the video is still published without them
+			log.Error().Msgf("Unable to measure rendition quality: %s\n", err)
+		}
+		EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+			encodingVideo.Quality = quality
+		})
+	}
+
+	// Describe the video alongside its streams for downstream indexing
+	err = writeVideoManifest(videoFolder, VideoManifest{Source: metadata, Loudness: loudness, Ladder: ladder, Quality: quality, Details: details, SourceCID: sourceCID})
+	if err != nil {
+		log.Error().Msgf("Unable to write video manifest: %s\n", err)
+		failVideoUpload(ctx, video, videoUUID, StageManifest, err)
 		return
 	}
 
 	// Remove scratch video file
-	os.Remove(video)
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobPinning
+	})
+	if isScratchVideo(video) {
+		os.Remove(video)
+		releaseDiskPath(videoUUID, video)
+	}
+
+	pinVideo(ctx, videoUUID, videoFolder, metadata, loudness)
+}
 
+// Adds the transcoded video folder to IPFS and marks the job as finished.
+// The job's scratch video file must already be removed.
+func pinVideo(ctx context.Context, videoUUID, videoFolder string, metadata *VideoMetadata, loudness *LoudnessMeasurement) {
 	// Add video folder to IPFS
 	videoCID, err := ipfs.AddFolderToIPFS(ctx, videoFolder)
 	if err != nil {
 		log.Error().Msgf("Unable to add video folder to IPFS: %s\n", err)
-		EncodingVideos.mutex.Lock()
-		EncodingVideos.Videos[videoUUID] = EncodingVideo{Error: err, CurrentProgress: -1}
-		EncodingVideos.mutex.Unlock()
+		failVideoUpload(ctx, "", videoUUID, StagePin, err)
 		return
 	}
+	ipfsAddedBytesMetric.Add(float64(folderSize(videoFolder)))
 	log.Info().Msgf("Video folder added to IPFS: %s\n", videoCID)
 
 	// Remove converted video folder
@@ -247,25 +603,149 @@ func asyncVideoUpload(video, videoUUID string) {
 	if err != nil {
 		log.Error().Msgf("Failed removing video folder: %s\n", err)
 	}
+	releaseDisk(videoUUID)
 
 	// Update the map with the video CID
-	EncodingVideos.mutex.Lock()
-	tempStruct := EncodingVideo{CID: videoCID, CurrentProgress: -1, Length: videoLength}
-	EncodingVideos.Videos[videoUUID] = tempStruct
-	EncodingVideos.mutex.Unlock()
+	apiKeyName, profile, ladder := "", EncodingProfile{}, []LadderRung(nil)
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobFinished
+		encodingVideo.CID = videoCID
+		encodingVideo.CurrentProgress = -1
+		encodingVideo.Length = videoLength(metadata)
+		encodingVideo.Loudness = loudness
+		apiKeyName, profile, ladder = encodingVideo.APIKey, encodingVideo.profile, encodingVideo.Ladder
+	})
+
+	// Count the transcoding time towards the key's usage
+	recordTranscodeMinutes(apiKeyName, jobTranscodeMinutes(metadata, profile, ladder))
+
+	log.Info().Msgf("Finished transcoding %s.\n", videoUUID)
+
+	notifyVideoCallback(videoUUID)
+	finishWatchedVideo(videoUUID)
+}
+
+// Marks the video as failed in the encoding map.
+// If the job was cancelled, its entry is already gone, so only the files it left behind are removed.
+func failVideoUpload(ctx context.Context, video, videoUUID, stage string, err error) {
+	releaseDisk(videoUUID)
+	if ctx.Err() != nil {
+		// Jobs interrupted by shutdown keep their files so they can be resumed
+		if shuttingDown() {
+			return
+		}
+		if isScratchVideo(video) {
+			os.Remove(video)
+		}
+		os.RemoveAll(path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID))
+		return
+	}
+
+	jobFailuresMetric.WithLabelValues(stage).Inc()
+	EncodingVideos.update(videoUUID, func(encodingVideo *EncodingVideo) {
+		encodingVideo.State = JobFailed
+		encodingVideo.Error = err
+		encodingVideo.CurrentProgress = -1
+	})
+
+	notifyVideoCallback(videoUUID)
+	finishWatchedVideo(videoUUID)
+}
+
+// Responds to a request naming a file on dapper's filesystem that cannot be used
+func rejectLocalPath(c echo.Context, field string, err error) error {
+	switch {
+	case errors.Is(err, errLocalPathsDisabled), errors.Is(err, errPathNotAllowed):
+		return c.String(http.StatusForbidden, fmt.Sprintf("%s: %s", field, err))
+	case errors.Is(err, os.ErrNotExist):
+		return c.String(http.StatusNotFound, fmt.Sprintf("%s does not exist", field))
+	default:
+		return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid %s: %s", field, err))
+	}
+}
+
+// Whether the video is an upload in the scratch folder that the job owns, rather than a file that must be left in place
+func isScratchVideo(video string) bool {
+	scratchFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder)
+	return video != "" && path.Dir(path.Clean(video)) == scratchFolder
+}
+
+// Fields of an upload's multipart form data
+type uploadForm struct {
+	profile string
+	// Name of the video given by the uploader
+	filename string
+	// Where the video was written in the scratch folder, and its size
+	videoFile string
+	size      int64
+}
+
+// Most bytes read from a form field other than the video
+const maxUploadFormValueSize = 4096
+
+// Reads an upload's multipart form data, writing the video to the scratch folder as it arrives
+// rather than letting it be spooled to the system's temp folder first, which may be on another disk.
+// The reserved size is reserved under the video's path before it is written, so what has been written counts against it.
+func readUploadForm(request *http.Request, videoUUID string, reservedSize int64) (uploadForm, *videoRejection, error) {
+	form := uploadForm{}
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return form, nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return form, nil, err
+		}
+
+		switch part.FormName() {
+		case "profile":
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFormValueSize+1))
+			if err != nil {
+				return form, nil, err
+			}
+			if len(value) > maxUploadFormValueSize {
+				return form, nil, errors.New("profile is too long")
+			}
+			form.profile = string(value)
+		case "video":
+			if form.videoFile != "" {
+				return form, nil, errors.New("more than one video was given")
+			}
+			form.filename = part.FileName()
+			form.videoFile = path.Join(viper.GetString("Videos.TempVideoStorageFolder"), VideoScratchFolder, videoUUID+"."+strings.Split(form.filename, ".")[len(strings.Split(form.filename, "."))-1])
+
+			if reservedSize > 0 {
+				if rejection := reserveDisk(videoUUID, form.videoFile, reservedSize); rejection != nil {
+					return form, rejection, nil
+				}
+			}
+			if form.size, err = writeMultiPartFormDataToDisk(part, form.videoFile); err != nil {
+				return form, nil, err
+			}
+		}
+	}
 
-	log.Info().Msgf("Finished transcoding %s.\n", video)
+	if form.videoFile == "" {
+		return form, nil, http.ErrMissingFile
+	}
+	return form, nil, nil
 }
 
 // Writes given multipart form data object to the file specified
-func writeMultiPartFormDataToDisk(multipartFormData io.ReadCloser, destFile string) error {
+func writeMultiPartFormDataToDisk(multipartFormData io.Reader, destFile string) (int64, error) {
 	tempFile, err := os.Create(destFile)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer tempFile.Close()
 
-	io.Copy(tempFile, multipartFormData)
-
-	return nil
+	size, err := io.Copy(tempFile, multipartFormData)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
 }
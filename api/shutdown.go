@@ -0,0 +1,304 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// State of an unfinished job, saved on shutdown so the job can be resumed when dapper restarts
+type jobCheckpoint struct {
+	ID        string               `json:"id"`
+	State     string               `json:"state"`
+	Source    string               `json:"source"`
+	Profile   EncodingProfile      `json:"profile"`
+	Metadata  *VideoMetadata       `json:"metadata"`
+	Loudness  *LoudnessMeasurement `json:"loudness,omitempty"`
+	Ladder    []LadderRung         `json:"ladder,omitempty"`
+	Quality   []RenditionQuality   `json:"quality,omitempty"`
+	Details   *VideoDetails        `json:"details,omitempty"`
+	SourceCID string               `json:"sourceCID,omitempty"`
+	// Set for jobs adding renditions, which fetch their source from FetchCID if it is not on disk
+	AddRenditions bool      `json:"addRenditions,omitempty"`
+	FetchCID      string    `json:"fetchCID,omitempty"`
+	APIKey        string    `json:"apiKey,omitempty"`
+	CallbackURL   string    `json:"callbackURL,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Name of the file unfinished jobs are saved to in the temp video storage folder
+const jobsStateFileName = "jobs.json"
+
+// Defaults and limits used when shutting down
+const (
+	defaultShutdownGracePeriod = 30 * time.Second
+	// How long interrupted jobs have to stop ffmpeg and pinning
+	jobStopTimeout = 30 * time.Second
+)
+
+// Goroutines running jobs, so shutdown can wait for interrupted jobs to stop
+var runningJobs sync.WaitGroup
+
+// Whether dapper is shutting down and no longer accepting uploads
+var shutdown = struct {
+	mutex        sync.Mutex
+	shuttingDown bool
+}{}
+
+// Stops accepting uploads, then waits up to the grace period for running jobs to finish.
+// Jobs still running after the grace period are interrupted and saved, to be resumed by `ResumeJobs` after a restart.
+func Shutdown(server *echo.Echo, gracePeriod time.Duration) {
+	if gracePeriod <= 0 {
+		gracePeriod = defaultShutdownGracePeriod
+	}
+	deadline := time.Now().Add(gracePeriod)
+
+	shutdown.mutex.Lock()
+	shutdown.shuttingDown = true
+	shutdown.mutex.Unlock()
+
+	// Let uploads that are already being received finish, so they are saved with the other jobs
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error().Msgf("Failed shutting down server: %s", err)
+	}
+
+	log.Info().Msgf("Waiting until %s for %d running jobs to finish", deadline.Format(time.RFC3339), unfinishedJobCount())
+	for unfinishedJobCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+
+	// Interrupt the remaining jobs, and wait for ffmpeg and pinning to stop before saving them
+	EncodingVideos.mutex.Lock()
+	for _, video := range EncodingVideos.Videos {
+		if video.CurrentProgress != -1 && video.cancel != nil {
+			video.cancel()
+		}
+	}
+	EncodingVideos.mutex.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		runningJobs.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(jobStopTimeout):
+		log.Warn().Msg("Timed out waiting for interrupted jobs to stop")
+	}
+
+	if err := saveJobCheckpoints(); err != nil {
+		log.Error().Msgf("Failed saving unfinished jobs: %s", err)
+	}
+}
+
+// Restarts the jobs saved by `Shutdown`.
+// Jobs that were pinning are pinned again, imports that were fetching are fetched again,
+// jobs adding renditions start over, and other jobs are transcoded again from their source.
+func ResumeJobs() {
+	stateFile := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), jobsStateFileName)
+	stateJSON, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Error().Msgf("Failed reading unfinished jobs: %s", err)
+		return
+	}
+
+	checkpoints := []jobCheckpoint{}
+	if err := json.Unmarshal(stateJSON, &checkpoints); err != nil {
+		log.Error().Msgf("Failed decoding unfinished jobs: %s", err)
+		return
+	}
+	os.Remove(stateFile)
+
+	for _, checkpoint := range checkpoints {
+		resumeJob(checkpoint)
+	}
+}
+
+// Middleware rejecting requests that would start new jobs while dapper is shutting down
+func rejectWhileShuttingDown(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if shuttingDown() {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(defaultShutdownGracePeriod.Seconds())))
+			return c.String(http.StatusServiceUnavailable, "dapper is shutting down")
+		}
+		return next(c)
+	}
+}
+
+// Whether dapper is shutting down
+func shuttingDown() bool {
+	shutdown.mutex.Lock()
+	defer shutdown.mutex.Unlock()
+
+	return shutdown.shuttingDown
+}
+
+// Runs a job in a goroutine that shutdown waits for
+func startJob(job func()) {
+	runningJobs.Add(1)
+	go func() {
+		defer runningJobs.Done()
+		job()
+	}()
+}
+
+// Private Functions
+
+// Number of jobs that have not finished or failed
+func unfinishedJobCount() int {
+	EncodingVideos.mutex.Lock()
+	defer EncodingVideos.mutex.Unlock()
+
+	jobs := 0
+	for _, video := range EncodingVideos.Videos {
+		if video.CurrentProgress != -1 {
+			jobs++
+		}
+	}
+	return jobs
+}
+
+// Writes the state of every unfinished job to the jobs state file
+func saveJobCheckpoints() error {
+	checkpoints := []jobCheckpoint{}
+
+	EncodingVideos.mutex.Lock()
+	for id, video := range EncodingVideos.Videos {
+		if video.CurrentProgress == -1 {
+			continue
+		}
+		checkpoints = append(checkpoints, jobCheckpoint{
+			ID:            id,
+			State:         video.State,
+			Source:        video.source,
+			Profile:       video.profile,
+			Metadata:      video.Metadata,
+			Loudness:      video.Loudness,
+			Ladder:        video.Ladder,
+			Quality:       video.Quality,
+			Details:       video.Details,
+			SourceCID:     video.SourceCID,
+			AddRenditions: video.addRenditions,
+			FetchCID:      video.fetchCID,
+			APIKey:        video.APIKey,
+			CallbackURL:   video.CallbackURL,
+			CreatedAt:     video.CreatedAt,
+		})
+	}
+	EncodingVideos.mutex.Unlock()
+
+	if len(checkpoints) == 0 {
+		return nil
+	}
+
+	stateJSON, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Saving %d unfinished jobs to resume after restart", len(checkpoints))
+	return os.WriteFile(path.Join(viper.GetString("Videos.TempVideoStorageFolder"), jobsStateFileName), stateJSON, 0644)
+}
+
+// Restores the job's entry in the encoding map and restarts it from the last stage that can be resumed
+func resumeJob(checkpoint jobCheckpoint) {
+	videoFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), checkpoint.ID)
+
+	// Adding renditions starts over, since the partial renditions are not worth keeping apart from the source
+	if checkpoint.AddRenditions {
+		video := EncodingVideo{APIKey: checkpoint.APIKey, CallbackURL: checkpoint.CallbackURL, SourceCID: checkpoint.SourceCID, CreatedAt: checkpoint.CreatedAt, profile: checkpoint.Profile, addRenditions: true, fetchCID: checkpoint.FetchCID}
+		if _, err := os.Stat(checkpoint.Source); checkpoint.Source != "" && err == nil {
+			video.source = checkpoint.Source
+		} else if checkpoint.FetchCID == "" {
+			log.Error().Msgf("Unable to resume job %s, its source video is missing", checkpoint.ID)
+			return
+		}
+		os.RemoveAll(videoFolder)
+
+		log.Info().Msgf("Resuming job %s", checkpoint.ID)
+		startRenditionsJob(checkpoint.ID, video)
+		return
+	}
+
+	// Imports that had not been fetched yet are fetched again
+	if checkpoint.State == JobFetching {
+		log.Info().Msgf("Resuming job %s", checkpoint.ID)
+		startImportJob(checkpoint.ID, EncodingVideo{APIKey: checkpoint.APIKey, CallbackURL: checkpoint.CallbackURL, SourceCID: checkpoint.SourceCID, CreatedAt: checkpoint.CreatedAt, profile: checkpoint.Profile})
+		return
+	}
+
+	// Pinning can be resumed as long as the transcoded video is intact, since the source has already been removed
+	pinning := checkpoint.State == JobPinning
+	var sourceSize int64
+	if pinning {
+		if _, err := os.Stat(path.Join(videoFolder, VideoManifestFilename)); err != nil {
+			log.Error().Msgf("Unable to resume pinning job %s, its transcoded video is missing", checkpoint.ID)
+			return
+		}
+	} else {
+		source, err := os.Stat(checkpoint.Source)
+		if err != nil {
+			log.Error().Msgf("Unable to resume job %s, its source video is missing", checkpoint.ID)
+			return
+		}
+		sourceSize = source.Size()
+		// Transcoding starts over, so remove any partial output
+		os.RemoveAll(videoFolder)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	video := EncodingVideo{State: JobQueued, TotalFrames: 1, Metadata: checkpoint.Metadata, Loudness: checkpoint.Loudness, Ladder: checkpoint.Ladder, Quality: checkpoint.Quality, Details: checkpoint.Details, SourceCID: checkpoint.SourceCID, APIKey: checkpoint.APIKey, CallbackURL: checkpoint.CallbackURL, CreatedAt: checkpoint.CreatedAt, cancel: cancel, source: checkpoint.Source, profile: checkpoint.Profile}
+	if pinning {
+		video.State = JobPinning
+	}
+	video.reservedMinutes = jobTranscodeMinutes(checkpoint.Metadata, checkpoint.Profile, checkpoint.Ladder)
+	insertJob(checkpoint.ID, video)
+
+	// Disk reservations are not saved, so reserve the space the job needs again the way it was reserved when it was queued
+	if !pinning {
+		if rejection := reserveResumedJob(checkpoint.ID, checkpoint.Source, sourceSize, videoFolder, checkpoint.Metadata, checkpoint.Profile); rejection != nil {
+			log.Info().Msgf("Unable to resume job %s: %s", checkpoint.ID, rejection.response.Error)
+			failVideoUpload(ctx, checkpoint.Source, checkpoint.ID, StageAnalysis, errors.New(rejection.response.Error))
+			return
+		}
+	}
+
+	log.Info().Msgf("Resuming job %s", checkpoint.ID)
+	if pinning {
+		startJob(func() { pinVideo(ctx, checkpoint.ID, videoFolder, checkpoint.Metadata, checkpoint.Loudness) })
+	} else {
+		startJob(func() {
+			asyncVideoUpload(ctx, checkpoint.Source, checkpoint.ID, checkpoint.Profile, checkpoint.Metadata)
+		})
+	}
+}
+
+// Reserves the space for a resumed job's scratch source, which is already on disk, and its transcoded video.
+// A job without room for its transcoded video is left queued until there is, if jobs are delayed for disk space.
+func reserveResumedJob(videoUUID, source string, sourceSize int64, videoFolder string, metadata *VideoMetadata, profile EncodingProfile) *videoRejection {
+	if isScratchVideo(source) {
+		if rejection := reserveDisk(videoUUID, source, sourceSize); rejection != nil {
+			return rejection
+		}
+	}
+	if rejection := reserveDisk(videoUUID, videoFolder, estimateHLSSize(metadata, profile)); rejection != nil && !shouldDelayForDisk(videoUUID) {
+		releaseDisk(videoUUID)
+		return rejection
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Body of a POST to "/upload-url".
+// Describes the constraints the upload made with the issued URL must follow.
+type UploadURLRequest struct {
+	// Maximum size of the video in bytes, 0 for the node's limit
+	MaxSize int64 `json:"maxSize"`
+	// Encoding profile the video will be transcoded with, empty for the default profile
+	Profile string `json:"profile"`
+	// URL the job's result is POSTed to when it finishes
+	CallbackURL string `json:"callbackURL"`
+	// Number of seconds the URL is valid for, 0 for the default lifetime
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// Response given by dapper to a POST to "/upload-url".
+// The video can be uploaded to the URL once, without an API key, until it expires.
+type UploadURLResponse struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Constraints signed into an upload token
+type uploadTokenClaims struct {
+	// Random ID making each token single use
+	ID          string `json:"id"`
+	APIKey      string `json:"key,omitempty"`
+	MaxSize     int64  `json:"maxSize,omitempty"`
+	Profile     string `json:"profile,omitempty"`
+	CallbackURL string `json:"callback,omitempty"`
+	ExpiresAt   int64  `json:"exp"`
+}
+
+// Lifetimes of upload tokens when not configured
+const (
+	defaultUploadTokenLifetime = 15 * time.Minute
+	defaultUploadTokenMaxLife  = time.Hour
+)
+
+// Shortest upload token secret accepted, the length of an HMAC-SHA256 key
+const minUploadTokenSecretLength = 32
+
+// Context key the claims of a verified upload token are stored under
+const uploadTokenContextKey = "uploadToken"
+
+// Name of the file the IDs of used upload tokens are saved to in the temp video storage folder
+const usedUploadTokensFileName = "uploadtokens.json"
+
+// Secret upload tokens are signed with
+var uploadTokenSecret []byte
+
+// IDs of upload tokens that have been used, mapped to when they expire.
+// Saved to disk as they change so tokens stay used after dapper restarts.
+var usedUploadTokens = struct {
+	mutex sync.Mutex
+	ids   map[string]time.Time
+}{ids: map[string]time.Time{}}
+
+// Reads the upload token secret from the config file.
+// If none is set, a random secret is generated, which invalidates issued tokens when dapper restarts.
+func loadUploadTokenSecret() error {
+	if secret := viper.GetString("Uploads.TokenSecret"); secret != "" {
+		if err := validateUploadTokenSecret(secret); err != nil {
+			return err
+		}
+		uploadTokenSecret = []byte(secret)
+		return nil
+	}
+
+	uploadTokenSecret = make([]byte, 32)
+	_, err := rand.Read(uploadTokenSecret)
+	return err
+}
+
+// Reads the IDs of the upload tokens used before dapper restarted
+func loadUsedUploadTokens() error {
+	usedJSON, err := os.ReadFile(usedUploadTokensFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	usedUploadTokens.mutex.Lock()
+	defer usedUploadTokens.mutex.Unlock()
+
+	return json.Unmarshal(usedJSON, &usedUploadTokens.ids)
+}
+
+// Routes
+
+// POSTs
+
+// Issues a signed URL a browser can upload a single video to without an API key
+func issueUploadURL(c echo.Context) error {
+	request := UploadURLRequest{}
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid upload URL request: "+err.Error())
+	}
+
+	// Make sure the constraints are valid now rather than when the upload is made
+	if _, err := getEncodingProfile(request.Profile); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid encoding profile: "+err.Error())
+	}
+	if request.CallbackURL != "" {
+		if callbackURL, err := url.Parse(request.CallbackURL); err != nil || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") {
+			return c.String(http.StatusBadRequest, "Invalid callback URL")
+		}
+	}
+	if request.MaxSize < 0 || request.ExpiresIn < 0 {
+		return c.String(http.StatusBadRequest, "maxSize and expiresIn must not be negative")
+	}
+
+	lifetime := defaultUploadTokenLifetime
+	if request.ExpiresIn > 0 {
+		lifetime = time.Duration(request.ExpiresIn) * time.Second
+	}
+	maxLifetime := viper.GetDuration("Uploads.TokenMaxLifetime")
+	if maxLifetime <= 0 {
+		maxLifetime = defaultUploadTokenMaxLife
+	}
+	if lifetime > maxLifetime {
+		return c.String(http.StatusBadRequest, "expiresIn is longer than the maximum of "+maxLifetime.String())
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Error().Msgf("Failed generating upload token ID: %s", err)
+		return c.String(http.StatusInternalServerError, "Failed generating upload token")
+	}
+
+	expiresAt := time.Now().Add(lifetime)
+	token, err := signUploadToken(uploadTokenClaims{
+		ID:          hex.EncodeToString(id),
+		APIKey:      requestAPIKeyName(c),
+		MaxSize:     request.MaxSize,
+		Profile:     request.Profile,
+		CallbackURL: request.CallbackURL,
+		ExpiresAt:   expiresAt.Unix(),
+	})
+	if err != nil {
+		log.Error().Msgf("Failed signing upload token: %s", err)
+		return c.String(http.StatusInternalServerError, "Failed generating upload token")
+	}
+
+	// Use the configured public URL when dapper is behind a proxy
+	baseURL := strings.TrimSuffix(viper.GetString("Uploads.PublicURL"), "/")
+	if baseURL == "" {
+		baseURL = c.Scheme() + "://" + c.Request().Host
+	}
+
+	return c.JSON(http.StatusCreated, UploadURLResponse{URL: baseURL + "/video?token=" + url.QueryEscape(token), Token: token, ExpiresAt: expiresAt})
+}
+
+// Middleware accepting either an API key with the given scope or a valid upload token in the `token` param
+func requireScopeOrUploadToken(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withScope := requireScope(scope)(next)
+
+		return func(c echo.Context) error {
+			token := c.QueryParam("token")
+			if token == "" {
+				return withScope(c)
+			}
+
+			claims, err := verifyUploadToken(token)
+			if err != nil {
+				return c.String(http.StatusUnauthorized, "Invalid upload token: "+err.Error())
+			}
+
+			c.Set(uploadTokenContextKey, claims)
+			return next(c)
+		}
+	}
+}
+
+// Returns the claims of the upload token the request was made with, or nil if it was made with an API key
+func requestUploadToken(c echo.Context) *uploadTokenClaims {
+	claims, _ := c.Get(uploadTokenContextKey).(*uploadTokenClaims)
+	return claims
+}
+
+// Checks that a configured upload token secret cannot be guessed
+func validateUploadTokenSecret(secret string) error {
+	if isPlaceholderSecret(secret) {
+		return errors.New("Uploads.TokenSecret is a placeholder, set it to a random secret")
+	}
+	if len(secret) < minUploadTokenSecretLength {
+		return fmt.Errorf("Uploads.TokenSecret must be at least %d bytes, not %d", minUploadTokenSecretLength, len(secret))
+	}
+	return nil
+}
+
+// Marks the upload token as used, returning false if it already was or another request is using it.
+// The token is released with `releaseUploadToken` if the upload is rejected, so it is only spent once its job is queued.
+func useUploadToken(claims *uploadTokenClaims) bool {
+	usedUploadTokens.mutex.Lock()
+	defer usedUploadTokens.mutex.Unlock()
+
+	// Forget tokens that have expired, since they are rejected anyways
+	now := time.Now()
+	for id, expiresAt := range usedUploadTokens.ids {
+		if now.After(expiresAt) {
+			delete(usedUploadTokens.ids, id)
+		}
+	}
+
+	if _, used := usedUploadTokens.ids[claims.ID]; used {
+		return false
+	}
+	usedUploadTokens.ids[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	saveUsedUploadTokens()
+	return true
+}
+
+// Makes an upload token that was marked by a rejected upload usable again
+func releaseUploadToken(claims *uploadTokenClaims) {
+	usedUploadTokens.mutex.Lock()
+	defer usedUploadTokens.mutex.Unlock()
+
+	delete(usedUploadTokens.ids, claims.ID)
+	saveUsedUploadTokens()
+}
+
+// Private Functions
+
+// Encodes the claims and signs them with HMAC-SHA256 as `<claims>.<signature>`
+func signUploadToken(claims uploadTokenClaims) (string, error) {
+	if len(uploadTokenSecret) < minUploadTokenSecretLength {
+		return "", errors.New("no upload token secret is set")
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(uploadTokenSignature(payload)), nil
+}
+
+// Checks the signature and expiry of the token and returns its claims
+func verifyUploadToken(token string) (*uploadTokenClaims, error) {
+	if len(uploadTokenSecret) < minUploadTokenSecretLength {
+		return nil, errors.New("upload tokens are not accepted, no upload token secret is set")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, uploadTokenSignature(parts[0])) {
+		return nil, errors.New("bad signature")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+
+	claims := &uploadTokenClaims{}
+	if err := json.Unmarshal(claimsJSON, claims); err != nil {
+		return nil, errors.New("malformed token")
+	}
+
+	if time.Now().After(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, errors.New("token has expired")
+	}
+
+	return claims, nil
+}
+
+// Writes the IDs of the used upload tokens to disk, `usedUploadTokens.mutex` must be held
+func saveUsedUploadTokens() {
+	usedJSON, err := json.Marshal(usedUploadTokens.ids)
+	if err != nil {
+		log.Error().Msgf("Failed encoding used upload tokens: %s", err)
+		return
+	}
+
+	if err := os.WriteFile(usedUploadTokensFilePath(), usedJSON, 0644); err != nil {
+		log.Error().Msgf("Failed saving used upload tokens: %s", err)
+	}
+}
+
+func usedUploadTokensFilePath() string {
+	return path.Join(viper.GetString("Videos.TempVideoStorageFolder"), usedUploadTokensFileName)
+}
+
+func uploadTokenSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, uploadTokenSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Signs tokens with the given secret for the rest of the test
+func setUploadTokenSecret(t *testing.T, secret string) {
+	previous := uploadTokenSecret
+	uploadTokenSecret = []byte(secret)
+	t.Cleanup(func() { uploadTokenSecret = previous })
+}
+
+func TestUploadTokenRoundTrip(t *testing.T) {
+	setUploadTokenSecret(t, strings.Repeat("k", minUploadTokenSecretLength))
+
+	claims := uploadTokenClaims{ID: "token", APIKey: "backend", MaxSize: 1 << 30, Profile: "hdr", CallbackURL: "https://example.com/done", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	token, err := signUploadToken(claims)
+	if err != nil {
+		t.Fatalf("signUploadToken() failed: %s", err)
+	}
+
+	verified, err := verifyUploadToken(token)
+	if err != nil {
+		t.Fatalf("verifyUploadToken() failed: %s", err)
+	}
+	if *verified != claims {
+		t.Errorf("verifyUploadToken() = %+v, want %+v", *verified, claims)
+	}
+}
+
+func TestVerifyUploadToken(t *testing.T) {
+	setUploadTokenSecret(t, strings.Repeat("k", minUploadTokenSecretLength))
+
+	valid, err := signUploadToken(uploadTokenClaims{ID: "valid", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("signUploadToken() failed: %s", err)
+	}
+	expired, err := signUploadToken(uploadTokenClaims{ID: "expired", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("signUploadToken() failed: %s", err)
+	}
+	payload, signature := splitToken(t, valid)
+
+	// Claims for a larger upload, signed with the signature of the valid token
+	forgedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"id":"valid","maxSize":1099511627776,"exp":9999999999}`))
+
+	// A token signed with another secret
+	uploadTokenSecret = []byte(strings.Repeat("o", minUploadTokenSecretLength))
+	otherSecret, err := signUploadToken(uploadTokenClaims{ID: "other", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("signUploadToken() failed: %s", err)
+	}
+	uploadTokenSecret = []byte(strings.Repeat("k", minUploadTokenSecretLength))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid", valid, ""},
+		{"expired", expired, "token has expired"},
+		{"forged claims", forgedPayload + "." + signature, "bad signature"},
+		{"signed with another secret", otherSecret, "bad signature"},
+		{"missing signature", payload, "malformed token"},
+		{"extra part", valid + ".extra", "malformed token"},
+		{"signature is not base64", payload + ".!!!", "bad signature"},
+		{"empty", "", "malformed token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verifyUploadToken(test.token)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("verifyUploadToken() failed: %s", err)
+			case test.wantErr != "" && (err == nil || err.Error() != test.wantErr):
+				t.Errorf("verifyUploadToken() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadTokensRequireSecret(t *testing.T) {
+	setUploadTokenSecret(t, strings.Repeat("k", minUploadTokenSecretLength))
+	token, err := signUploadToken(uploadTokenClaims{ID: "token", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("signUploadToken() failed: %s", err)
+	}
+
+	uploadTokenSecret = []byte("short")
+	if _, err := signUploadToken(uploadTokenClaims{ID: "token"}); err == nil {
+		t.Error("signUploadToken() with a short secret succeeded, want an error")
+	}
+	if _, err := verifyUploadToken(token); err == nil {
+		t.Error("verifyUploadToken() with a short secret succeeded, want an error")
+	}
+}
+
+func TestValidateUploadTokenSecret(t *testing.T) {
+	tests := []struct {
+		secret  string
+		wantErr bool
+	}{
+		{strings.Repeat("a1", 16), false},
+		{strings.Repeat("a", minUploadTokenSecretLength-1), true},
+		{"change-me", true},
+		{" Change-Me ", true},
+		{"secret", true},
+		{"", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.secret, func(t *testing.T) {
+			if err := validateUploadTokenSecret(test.secret); (err != nil) != test.wantErr {
+				t.Errorf("validateUploadTokenSecret(%q) error = %v, want error %v", test.secret, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadTokenSingleUse(t *testing.T) {
+	viper.Set("Videos.TempVideoStorageFolder", t.TempDir())
+	t.Cleanup(func() { viper.Set("Videos.TempVideoStorageFolder", "") })
+
+	claims := &uploadTokenClaims{ID: "single-use", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	t.Cleanup(func() { releaseUploadToken(claims) })
+
+	if !useUploadToken(claims) {
+		t.Fatal("useUploadToken() = false for an unused token")
+	}
+	if useUploadToken(claims) {
+		t.Error("useUploadToken() = true for a token in use")
+	}
+
+	// Rejected uploads give the token back
+	releaseUploadToken(claims)
+	if !useUploadToken(claims) {
+		t.Error("useUploadToken() = false for a released token")
+	}
+
+	// Used tokens are read back after a restart
+	usedUploadTokens.ids = map[string]time.Time{}
+	if err := loadUsedUploadTokens(); err != nil {
+		t.Fatalf("loadUsedUploadTokens() failed: %s", err)
+	}
+	if useUploadToken(claims) {
+		t.Error("useUploadToken() = true for a token used before a restart")
+	}
+}
+
+func splitToken(t *testing.T, token string) (payload, signature string) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		t.Fatalf("token %q does not have two parts", token)
+	}
+	return parts[0], parts[1]
+}
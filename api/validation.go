@@ -0,0 +1,181 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/viper"
+)
+
+// Response given by dapper when an uploaded video is rejected before it is queued.
+// Reason is a stable identifier callers can match on, Error is a human readable description.
+type VideoRejectedResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// Reasons an upload can be rejected for
+const (
+	RejectUnreadable         = "unreadable"
+	RejectNoVideoStream      = "no_video_stream"
+	RejectFileTooLarge       = "file_too_large"
+	RejectDurationExceeded   = "duration_exceeded"
+	RejectResolutionExceeded = "resolution_exceeded"
+	RejectCodecDenied        = "codec_denied"
+	// The node does not have the disk space to store and transcode the video
+	RejectInsufficientStorage = "insufficient_storage"
+)
+
+// An upload that failed validation, along with the HTTP status it should be rejected with
+type videoRejection struct {
+	status   int
+	response VideoRejectedResponse
+}
+
+func newVideoRejection(status int, reason, format string, args ...interface{}) *videoRejection {
+	return &videoRejection{status: status, response: VideoRejectedResponse{Reason: reason, Error: fmt.Sprintf(format, args...)}}
+}
+
+// Parses a size with units from the config file, such as "10GB" (10^10 bytes) or "10GiB" (10 * 2^30 bytes).
+// Every size in the config file is parsed this way, so its units mean the same thing everywhere.
+func parseSize(size string) (int64, error) {
+	bytes, err := humanize.ParseBytes(size)
+	return int64(bytes), err
+}
+
+// Maximum size of an uploaded video from `Uploads.MaxFileSize`, 0 if there is no limit
+func maxUploadFileSize() int64 {
+	maxFileSize, err := parseSize(viper.GetString("Uploads.MaxFileSize"))
+	if err != nil {
+		return 0
+	}
+	return maxFileSize
+}
+
+// Checks the size of an upload against the configured limit before it is written to disk
+func validateUploadSize(size int64) *videoRejection {
+	maxFileSize := maxUploadFileSize()
+	if maxFileSize > 0 && size > maxFileSize {
+		return newVideoRejection(http.StatusRequestEntityTooLarge, RejectFileTooLarge, "video is %d bytes, the limit is %d bytes", size, maxFileSize)
+	}
+
+	return nil
+}
+
+// Room allowed for the other fields and the boundaries of a multipart upload, on top of the video itself
+const multipartOverhead = 1 << 20
+
+// Returned while reading an upload body that has gone over its limit
+var errUploadTooLarge = errors.New("upload is over the size limit")
+
+// Request body that stops being read once it goes over the size limit of the upload
+type limitedUploadBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+// Largest video the request may upload, from `Uploads.MaxFileSize` and the limit of the upload token it was made with.
+// Returns 0 if there is no limit.
+func uploadSizeLimit(token *uploadTokenClaims) int64 {
+	limit := maxUploadFileSize()
+	if token != nil && token.MaxSize > 0 && (limit <= 0 || token.MaxSize < limit) {
+		limit = token.MaxSize
+	}
+	return limit
+}
+
+// Rejects an upload whose Content-Length is over the limit, and otherwise limits its body so an upload without one
+// is cut off once it goes over, rather than being spooled to disk in full before its size is checked.
+// Returns nil for the body if there is no limit.
+func limitUploadBody(request *http.Request, limit int64) (*limitedUploadBody, *videoRejection) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	if request.ContentLength > limit+multipartOverhead {
+		return nil, newVideoRejection(http.StatusRequestEntityTooLarge, RejectFileTooLarge, "upload is %d bytes, the limit is %d bytes", request.ContentLength, limit)
+	}
+
+	body := &limitedUploadBody{ReadCloser: request.Body, remaining: limit + multipartOverhead}
+	request.Body = body
+	return body, nil
+}
+
+func (body *limitedUploadBody) Read(p []byte) (int, error) {
+	if body.exceeded {
+		return 0, errUploadTooLarge
+	}
+
+	// Read a byte past the limit to tell a body that ends at the limit from one that goes over it
+	if int64(len(p)) > body.remaining+1 {
+		p = p[:body.remaining+1]
+	}
+	n, err := body.ReadCloser.Read(p)
+	if int64(n) > body.remaining {
+		n, body.remaining, body.exceeded = int(body.remaining), 0, true
+		return n, errUploadTooLarge
+	}
+
+	body.remaining -= int64(n)
+	return n, err
+}
+
+// Probes the given video and checks that dapper is able and allowed to transcode it
+func validateVideo(videoFile string) (*VideoMetadata, *videoRejection) {
+	metadata, err := probeVideo(videoFile)
+	if err != nil {
+		return nil, newVideoRejection(http.StatusUnsupportedMediaType, RejectUnreadable, "video could not be read: %s", err)
+	}
+
+	videoStream := firstVideoStream(metadata)
+	if videoStream == nil || videoStream.Width <= 0 || videoStream.Height <= 0 {
+		return nil, newVideoRejection(http.StatusUnsupportedMediaType, RejectNoVideoStream, "video does not contain a decodable video stream")
+	}
+
+	for _, deniedCodec := range viper.GetStringSlice("Uploads.DeniedCodecs") {
+		for _, stream := range metadata.Streams {
+			if strings.EqualFold(stream.Codec, deniedCodec) {
+				return nil, newVideoRejection(http.StatusUnsupportedMediaType, RejectCodecDenied, "%s stream uses the codec %s, which is not accepted", stream.Type, stream.Codec)
+			}
+		}
+	}
+
+	maxDuration := viper.GetDuration("Uploads.MaxDuration")
+	if maxDuration > 0 && metadata.Duration > maxDuration.Seconds() {
+		return nil, newVideoRejection(http.StatusUnprocessableEntity, RejectDurationExceeded, "video is %s long, the limit is %s", time.Duration(metadata.Duration*float64(time.Second)).Round(time.Second), maxDuration)
+	}
+
+	width, height := displayResolution(videoStream)
+	maxWidth, maxHeight := viper.GetInt("Uploads.MaxWidth"), viper.GetInt("Uploads.MaxHeight")
+	if (maxWidth > 0 && width > maxWidth) || (maxHeight > 0 && height > maxHeight) {
+		return nil, newVideoRejection(http.StatusUnprocessableEntity, RejectResolutionExceeded, "video is %dx%d, the limit is %dx%d", width, height, maxWidth, maxHeight)
+	}
+
+	if rejection := validateUploadSize(metadata.Size); rejection != nil {
+		return nil, rejection
+	}
+
+	// Probing only reads the headers, so make sure the video stream can actually be decoded
+	if err := decodeFirstFrame(videoFile, videoStream.Index); err != nil {
+		return nil, newVideoRejection(http.StatusUnsupportedMediaType, RejectUnreadable, "video stream could not be decoded: %s", err)
+	}
+
+	return metadata, nil
+}
+
+// Uses ffmpeg to decode the first frame of the given stream
+func decodeFirstFrame(videoFile string, streamIndex int) error {
+	cmd := exec.Command(viper.GetString("ffmpeg.ffmpegDir"), "-v", "error", "-xerror", "-i", videoFile, "-map", fmt.Sprintf("0:%d", streamIndex), "-frames:v", "1", "-f", "null", "-")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + " | " + err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Sidecar file giving the options for a video in the watch folder.
+// It is named after the video with a `.json` extension, such as `clip.json` for `clip.mp4`.
+type watchSidecar struct {
+	Profile string `json:"profile"`
+}
+
+// Subfolders of the watch folder that processed videos are moved to
+const (
+	WatchDoneFolder   = "done"
+	WatchFailedFolder = "failed"
+)
+
+// How often the watch folder is polled when `Watch.PollInterval` is not configured
+const defaultWatchPollInterval = 5 * time.Second
+
+// Size and modification time of a file in the watch folder
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// Files in the watch folder, the mutex serializes polls with jobs finishing
+var watch = struct {
+	mutex sync.Mutex
+	// Files as they were on the last poll, a file is fully written once it is unchanged between polls
+	seen map[string]watchedFile
+	// IDs of the jobs transcoding files in the folder
+	jobs map[string]string
+}{seen: map[string]watchedFile{}, jobs: map[string]string{}}
+
+// Polls `Watch.Folder` every `Watch.PollInterval` until ctx is cancelled, queuing a job for each video written to it.
+// Does nothing if no watch folder is configured.
+func StartWatchFolder(ctx context.Context) {
+	folder := viper.GetString("Watch.Folder")
+	if folder == "" {
+		return
+	}
+	folder = path.Clean(folder)
+
+	for _, subfolder := range []string{WatchDoneFolder, WatchFailedFolder} {
+		if err := os.MkdirAll(path.Join(folder, subfolder), 0755); err != nil {
+			log.Error().Msgf("Failed creating watch folder: %s", err)
+			return
+		}
+	}
+
+	interval := viper.GetDuration("Watch.PollInterval")
+	if interval <= 0 {
+		interval = defaultWatchPollInterval
+	}
+
+	// Pick up the jobs resumed after a restart, so their videos are not queued again
+	watch.mutex.Lock()
+	EncodingVideos.mutex.Lock()
+	for id, video := range EncodingVideos.Videos {
+		if path.Dir(video.source) == folder {
+			watch.jobs[path.Base(video.source)] = id
+		}
+	}
+	EncodingVideos.mutex.Unlock()
+	watch.mutex.Unlock()
+
+	log.Info().Msgf("Watching %s for videos", folder)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pollWatchFolder(folder)
+	}
+}
+
+// Private Functions
+
+// Queues the videos that have been fully written to the watch folder since the last poll
+func pollWatchFolder(folder string) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		log.Error().Msgf("Failed reading watch folder: %s", err)
+		return
+	}
+
+	watch.mutex.Lock()
+	defer watch.mutex.Unlock()
+
+	present := map[string]bool{}
+	for _, entry := range entries {
+		// Skip subfolders, sidecars and the hidden temporary files editing software writes while exporting
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".json") {
+			continue
+		}
+		present[name] = true
+
+		if id, ok := watch.jobs[name]; ok {
+			// Jobs that finish are moved by `finishWatchedVideo`, so a job that is gone was cancelled
+			EncodingVideos.mutex.Lock()
+			_, running := EncodingVideos.Videos[id]
+			EncodingVideos.mutex.Unlock()
+
+			if !running {
+				delete(watch.jobs, name)
+				moveWatchedVideo(folder, name, VideoCallbackPayload{ID: id, VideoEncodingStatusResponse: VideoEncodingStatusResponse{State: JobFailed, Finished: true, Error: "job was cancelled"}})
+			}
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		current := watchedFile{size: info.Size(), modTime: info.ModTime()}
+		last, seen := watch.seen[name]
+		watch.seen[name] = current
+
+		if !seen || last != current || current.size == 0 || shuttingDown() {
+			continue
+		}
+		if queueWatchedVideo(folder, name) {
+			delete(watch.seen, name)
+		}
+	}
+
+	for name := range watch.seen {
+		if !present[name] {
+			delete(watch.seen, name)
+		}
+	}
+}
+
+// Starts a job for a fully written video in the watch folder, or moves it to the failed folder if it cannot be transcoded.
+// Returns false if the video should be tried again on a later poll.
+func queueWatchedVideo(folder, name string) bool {
+	videoFile := path.Join(folder, name)
+
+	sidecar, err := readWatchSidecar(folder, name)
+	if err != nil {
+		log.Info().Msgf("Rejected watched video %s: %s", name, err)
+		moveWatchedVideo(folder, name, failedWatchResult(err.Error()))
+		return true
+	}
+
+	profile, err := getJobProfile(sidecar.Profile, "")
+	if err != nil {
+		log.Info().Msgf("Rejected watched video %s: %s", name, err)
+		moveWatchedVideo(folder, name, failedWatchResult(fmt.Sprintf("invalid encoding profile: %s", err)))
+		return true
+	}
+
+	metadata, rejection := validateVideo(videoFile)
+	if rejection != nil {
+		log.Info().Msgf("Rejected watched video %s: %s", name, rejection.response.Error)
+		moveWatchedVideo(folder, name, failedWatchResult(rejection.response.Error))
+		return true
+	}
+
+	// The video is already on disk, so only its transcoded streams need room.
+	// Without room it stays in the folder until there is, unless jobs are configured to wait for it.
+	videoUUID := uuid.New().String()
+	videoFolder := path.Join(viper.GetString("Videos.TempVideoStorageFolder"), videoUUID)
+	if rejection := reserveDisk(videoUUID, videoFolder, estimateHLSSize(metadata, profile)); rejection != nil {
+		if !shouldDelayForDisk(videoUUID) {
+			log.Info().Msgf("Not queuing watched video %s yet: %s", name, rejection.response.Error)
+			releaseDisk(videoUUID)
+			return false
+		}
+		log.Info().Msgf("Delaying watched video %s until there is disk space: %s", name, rejection.response.Error)
+	}
+
+	watch.jobs[name] = videoUUID
+	startVideoJob(videoUUID, EncodingVideo{Metadata: metadata, source: videoFile, profile: profile})
+	log.Info().Msgf("Queued watched video %s as %s", name, videoUUID)
+
+	return true
+}
+
+// Moves the video of a finished job to the done or failed folder with its result, if it came from the watch folder.
+// The job's entry is removed, since its result has been delivered.
+func finishWatchedVideo(videoUUID string) {
+	EncodingVideos.mutex.Lock()
+	video, ok := EncodingVideos.Videos[videoUUID]
+	EncodingVideos.mutex.Unlock()
+
+	folder := viper.GetString("Watch.Folder")
+	if !ok || folder == "" || path.Dir(video.source) != path.Clean(folder) {
+		return
+	}
+
+	watch.mutex.Lock()
+	defer watch.mutex.Unlock()
+
+	name := path.Base(video.source)
+	delete(watch.jobs, name)
+	moveWatchedVideo(path.Clean(folder), name, videoResult(videoUUID, video))
+
+	EncodingVideos.mutex.Lock()
+	delete(EncodingVideos.Videos, videoUUID)
+	EncodingVideos.mutex.Unlock()
+}
+
+// Reads the sidecar of the video, using the default encoding profile if there is none
+func readWatchSidecar(folder, name string) (watchSidecar, error) {
+	sidecar := watchSidecar{}
+
+	sidecarJSON, err := os.ReadFile(path.Join(folder, watchBaseName(name)+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return sidecar, nil
+	} else if err != nil {
+		return sidecar, err
+	}
+
+	if err := json.Unmarshal(sidecarJSON, &sidecar); err != nil {
+		return sidecar, fmt.Errorf("invalid sidecar file: %s", err)
+	}
+	return sidecar, nil
+}
+
+// Moves the video and its sidecar to the done folder, or the failed folder if the result has an error,
+// and writes the result next to them as `<name>.result.json`
+func moveWatchedVideo(folder, name string, result VideoCallbackPayload) {
+	destFolder := path.Join(folder, WatchDoneFolder)
+	if result.Error != "" {
+		destFolder = path.Join(folder, WatchFailedFolder)
+	}
+	baseName := watchBaseName(name)
+
+	// Keep earlier videos of the same name, by naming this one and its files after its job
+	destName, destBaseName := name, baseName
+	if watchDestinationTaken(destFolder, name) {
+		suffix := result.ID
+		if suffix == "" {
+			suffix = uuid.New().String()
+		}
+		destBaseName = baseName + "-" + suffix
+		destName = destBaseName + path.Ext(name)
+	}
+
+	if err := os.Rename(path.Join(folder, name), path.Join(destFolder, destName)); err != nil {
+		log.Error().Msgf("Failed moving watched video %s: %s", name, err)
+	}
+	if err := os.Rename(path.Join(folder, baseName+".json"), path.Join(destFolder, destBaseName+".json")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error().Msgf("Failed moving sidecar of watched video %s: %s", name, err)
+	}
+
+	resultJSON, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Error().Msgf("Failed encoding result of watched video %s: %s", name, err)
+		return
+	}
+	if err := os.WriteFile(path.Join(destFolder, destBaseName+".result.json"), resultJSON, 0644); err != nil {
+		log.Error().Msgf("Failed writing result of watched video %s: %s", name, err)
+	}
+}
+
+// Whether a video of the same name, or its sidecar or result, has already been moved to the folder
+func watchDestinationTaken(destFolder, name string) bool {
+	baseName := watchBaseName(name)
+	for _, taken := range []string{name, baseName + ".json", baseName + ".result.json"} {
+		if _, err := os.Stat(path.Join(destFolder, taken)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Result for a watched video that was rejected before a job was started for it
+func failedWatchResult(reason string) VideoCallbackPayload {
+	return VideoCallbackPayload{VideoEncodingStatusResponse: VideoEncodingStatusResponse{State: JobFailed, Finished: true, Error: reason}}
+}
+
+// Name of the video without its extension, which its sidecar and result are named after
+func watchBaseName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name))
+}
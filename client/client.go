@@ -0,0 +1,212 @@
+// Package client talks to the REST API of a running dapper daemon
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gatsby-tv/dapper/types"
+)
+
+// Client for a dapper daemon
+type Client struct {
+	// Base URL of the daemon, such as "http://localhost:10000"
+	URL string
+	// API key sent with every request, empty if the daemon does not require one
+	APIKey string
+
+	httpClient http.Client
+}
+
+// Creates a client for the daemon at the given URL
+func New(daemonURL, apiKey string) *Client {
+	return &Client{URL: strings.TrimSuffix(daemonURL, "/"), APIKey: apiKey}
+}
+
+// Uploads a video to be transcoded with the named encoding profile, returning the ID of its job.
+// If onProgress is given, it is called with the number of bytes sent as the upload progresses.
+func (client *Client) Upload(ctx context.Context, videoFile, profile string, onProgress func(sent, total int64)) (string, error) {
+	video, err := os.Open(videoFile)
+	if err != nil {
+		return "", err
+	}
+	defer video.Close()
+
+	info, err := video.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Stream the form rather than buffering the whole video in memory
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		if profile != "" {
+			if err := form.WriteField("profile", profile); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := form.CreateFormFile("video", filepath.Base(videoFile))
+		if err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(part, &progressReader{reader: video, total: info.Size(), onProgress: onProgress})
+		if err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		writer.CloseWithError(form.Close())
+	}()
+
+	req, err := client.newRequest(ctx, http.MethodPost, "/video", nil, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	response := types.VideoStartEncodingResponse{}
+	if err := client.do(req, &response, http.StatusAccepted); err != nil {
+		return "", err
+	}
+	return response.ID, nil
+}
+
+// Returns the status of a job.
+// Dapper forgets a job once its finished status has been returned, so this only succeeds once for a finished job.
+func (client *Client) Status(ctx context.Context, id string) (*types.VideoEncodingStatusResponse, error) {
+	req, err := client.newRequest(ctx, http.MethodGet, "/status", url.Values{"id": {id}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failed jobs are reported with a 500 along with their status
+	status := &types.VideoEncodingStatusResponse{}
+	if err := client.do(req, status, http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusInternalServerError); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Polls the status of a job until it finishes, calling onStatus with each status
+func (client *Client) Follow(ctx context.Context, id string, interval time.Duration, onStatus func(*types.VideoEncodingStatusResponse)) (*types.VideoEncodingStatusResponse, error) {
+	for {
+		status, err := client.Status(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if onStatus != nil {
+			onStatus(status)
+		}
+		if status.Finished {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Lists the jobs visible to the client's API key
+func (client *Client) List(ctx context.Context) ([]types.VideoJobSummary, error) {
+	req, err := client.newRequest(ctx, http.MethodGet, "/videos", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []types.VideoJobSummary{}
+	if err := client.do(req, &jobs, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Cancels a running job, or forgets a finished one
+func (client *Client) Delete(ctx context.Context, id string) error {
+	req, err := client.newRequest(ctx, http.MethodDelete, "/video", url.Values{"id": {id}}, nil)
+	if err != nil {
+		return err
+	}
+	return client.do(req, nil, http.StatusNoContent)
+}
+
+// Private Functions
+
+func (client *Client) newRequest(ctx context.Context, method, route string, params url.Values, body io.Reader) (*http.Request, error) {
+	requestURL := client.URL + route
+	if len(params) > 0 {
+		requestURL += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if client.APIKey != "" {
+		req.Header.Set("X-API-Key", client.APIKey)
+	}
+	return req, nil
+}
+
+// Sends the request and decodes its JSON response into response, if the status is one of the expected statuses
+func (client *Client) do(req *http.Request, response interface{}, expectedStatuses ...int) error {
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	expected := false
+	for _, status := range expectedStatuses {
+		expected = expected || res.StatusCode == status
+	}
+	if !expected {
+		return fmt.Errorf("dapper responded with %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	if response == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("failed decoding response from dapper: %s", err)
+	}
+	return nil
+}
+
+// Reader reporting how much of the underlying reader has been read
+type progressReader struct {
+	reader     io.Reader
+	sent       int64
+	total      int64
+	onProgress func(sent, total int64)
+}
+
+func (reader *progressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.sent += int64(n)
+	if reader.onProgress != nil {
+		reader.onProgress(reader.sent, reader.total)
+	}
+	return n, err
+}
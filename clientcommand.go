@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rs/zerolog/log"
+
+	"github.com/gatsby-tv/dapper/client"
+	"github.com/gatsby-tv/dapper/types"
+)
+
+const clientUsage = `Usage: dapper client [-url url] [-key key] <command> [arguments]
+
+Commands:
+  upload <file> [-profile name] [-follow]    Upload a video and print its job ID, or its CID with -follow
+  status <id> [-follow]                      Print the status of a job, or follow it until it finishes
+  list                                       List jobs
+  cancel <id>                                Cancel a running job, or forget a finished one
+
+The URL and API key default to the DAPPER_URL and DAPPER_API_KEY environment variables.
+`
+
+// How often a followed job's status is checked
+const followInterval = 2 * time.Second
+
+// Width of the upload progress bar in characters
+const progressBarWidth = 30
+
+// Talks to the REST API of a running daemon
+func clientCommand(args []string) {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, clientUsage) }
+	daemonURL := flags.String("url", envOrDefault("DAPPER_URL", "http://localhost:10000"), "URL of the dapper daemon.")
+	apiKey := flags.String("key", os.Getenv("DAPPER_API_KEY"), "API key to authenticate with.")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dapper := client.New(*daemonURL, *apiKey)
+	command, args := flags.Arg(0), flags.Args()[1:]
+
+	switch command {
+	case "upload":
+		clientUpload(ctx, dapper, args)
+	case "status":
+		clientStatus(ctx, dapper, args)
+	case "list":
+		clientList(ctx, dapper)
+	case "cancel", "delete":
+		clientCancel(ctx, dapper, args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown client command %q\n\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// Private Functions
+
+func clientUpload(ctx context.Context, dapper *client.Client, args []string) {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	profile := flags.String("profile", "", "Encoding profile to transcode with.")
+	follow := flags.Bool("follow", false, "Follow the job until it finishes and print its CID.")
+	positional := parseFlags(flags, args)
+
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dapper client upload <file> [-profile name] [-follow]")
+		os.Exit(2)
+	}
+
+	id, err := dapper.Upload(ctx, positional[0], *profile, printUploadProgress)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatal().Msgf("Failed uploading %s: %s", positional[0], err)
+	}
+
+	if !*follow {
+		fmt.Println(id)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Job %s\n", id)
+	followJob(ctx, dapper, id)
+}
+
+func clientStatus(ctx context.Context, dapper *client.Client, args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	follow := flags.Bool("follow", false, "Follow the job until it finishes and print its CID.")
+	positional := parseFlags(flags, args)
+
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dapper client status <id> [-follow]")
+		os.Exit(2)
+	}
+
+	if *follow {
+		followJob(ctx, dapper, positional[0])
+		return
+	}
+
+	status, err := dapper.Status(ctx, positional[0])
+	if err != nil {
+		log.Fatal().Msgf("Failed getting status of %s: %s", positional[0], err)
+	}
+	printJobResult(status)
+}
+
+func clientList(ctx context.Context, dapper *client.Client) {
+	jobs, err := dapper.List(ctx)
+	if err != nil {
+		log.Fatal().Msgf("Failed listing jobs: %s", err)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tSTATE\tPROGRESS\tCID\tKEY\tCREATED")
+	for _, job := range jobs {
+		progress := fmt.Sprintf("%d%%", job.Progress)
+		if job.Finished {
+			progress = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.State, progress, job.CID, job.APIKey, humanize.Time(job.CreatedAt))
+	}
+	table.Flush()
+}
+
+func clientCancel(ctx context.Context, dapper *client.Client, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dapper client cancel <id>")
+		os.Exit(2)
+	}
+
+	if err := dapper.Delete(ctx, args[0]); err != nil {
+		log.Fatal().Msgf("Failed cancelling %s: %s", args[0], err)
+	}
+	fmt.Fprintf(os.Stderr, "Cancelled %s\n", args[0])
+}
+
+// Prints the job's progress until it finishes, then prints its result
+func followJob(ctx context.Context, dapper *client.Client, id string) {
+	status, err := dapper.Follow(ctx, id, followInterval, func(status *types.VideoEncodingStatusResponse) {
+		if !status.Finished {
+			fmt.Fprintf(os.Stderr, "\r%-10s %3d%%", status.State, status.Progress)
+		}
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatal().Msgf("Failed following %s: %s", id, err)
+	}
+	printJobResult(status)
+}
+
+// Prints the CID of a finished job, or its state and progress, exiting with an error if the job failed
+func printJobResult(status *types.VideoEncodingStatusResponse) {
+	switch {
+	case status.Finished && status.Error != "":
+		fmt.Fprintf(os.Stderr, "Job failed: %s\n", status.Error)
+		os.Exit(1)
+	case status.Finished:
+		fmt.Println(status.CID)
+	default:
+		fmt.Printf("%s %d%%\n", status.State, status.Progress)
+	}
+}
+
+// Draws a progress bar for the upload on stderr
+func printUploadProgress(sent, total int64) {
+	filled := progressBarWidth
+	percent := int64(100)
+	if total > 0 {
+		filled = int(sent * progressBarWidth / total)
+		percent = sent * 100 / total
+	}
+	// The file can grow while it is being sent, so keep the bar within its width
+	if filled < 0 {
+		filled = 0
+	} else if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Fprintf(os.Stderr, "\rUploading [%s] %3d%% %s/%s", bar, percent, humanize.Bytes(uint64(sent)), humanize.Bytes(uint64(total)))
+}
+
+func envOrDefault(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
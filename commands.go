@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gatsby-tv/dapper/api"
+	"github.com/gatsby-tv/dapper/ipfs"
+)
+
+// Commands for batch work on local files, without running the daemon
+
+const usage = `Usage: dapper <command> [arguments]
+
+Commands:
+  serve [-p port]                               Run the daemon (the default when no command is given)
+  transcode <file> -o <dir> [-profile name]     Transcode a video to HLS in a folder, without IPFS
+  add <path>                                    Add a folder or file to IPFS and print its CID
+  probe <file>                                  Print the metadata of a video as JSON
+  config check                                  Check the configuration file for problems
+  client <command> [arguments]                  Upload to and manage jobs on a running daemon, see "dapper client"
+`
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, usage)
+}
+
+// Transcodes a video to the HLS ladder in a local folder and prints the path of its master playlist
+func transcodeCommand(args []string) {
+	flags := flag.NewFlagSet("transcode", flag.ExitOnError)
+	outputFolder := flags.String("o", "", "Folder to write the HLS streams to.")
+	profile := flags.String("profile", "", "Encoding profile to transcode with.")
+	positional := parseFlags(flags, args)
+
+	if len(positional) != 1 || *outputFolder == "" {
+		fmt.Fprintln(os.Stderr, "Usage: dapper transcode <file> -o <dir> [-profile name]")
+		os.Exit(2)
+	}
+
+	readConfigFile()
+
+	// Stop ffmpeg if interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	_, err := api.TranscodeVideo(ctx, positional[0], *outputFolder, *profile, func(progress int64) {
+		fmt.Fprintf(os.Stderr, "\rTranscoding: %d%%", progress)
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatal().Msgf("Failed transcoding %s: %s", positional[0], err)
+	}
+
+	fmt.Println(filepath.Join(*outputFolder, "master.m3u8"))
+}
+
+// Adds a folder or file to IPFS and prints its CID.
+// Uses the configured or running IPFS node if there is one, otherwise the embedded node is started just for the add.
+func addCommand(args []string) {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	positional := parseFlags(flags, args)
+
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dapper add <path>")
+		os.Exit(2)
+	}
+
+	info, err := os.Stat(positional[0])
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	readConfigFile()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := ipfs.StartIPFS(ctx); err != nil {
+		log.Fatal().Msgf("Failed to start IPFS: %s", err)
+	}
+
+	var cid string
+	if info.IsDir() {
+		cid, err = ipfs.AddFolderToIPFS(ctx, positional[0])
+	} else {
+		cid, err = ipfs.AddFileToIPFS(ctx, positional[0])
+	}
+
+	// Close the embedded node before exiting, so its repo is left in a clean state
+	cancel()
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), ipfsCloseTimeout)
+	defer closeCancel()
+	ipfs.WaitForClose(closeCtx)
+
+	if err != nil {
+		log.Fatal().Msgf("Failed adding %s to IPFS: %s", positional[0], err)
+	}
+
+	fmt.Println(cid)
+}
+
+// Prints the metadata of a video as JSON
+func probeCommand(args []string) {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	positional := parseFlags(flags, args)
+
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: dapper probe <file>")
+		os.Exit(2)
+	}
+
+	readConfigFile()
+
+	metadata, err := api.ProbeVideo(positional[0])
+	if err != nil {
+		log.Fatal().Msgf("Failed probing %s: %s", positional[0], err)
+	}
+
+	metadataJSON, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	fmt.Println(string(metadataJSON))
+}
+
+// Checks the configuration file, exiting with an error if there are any problems
+func configCommand(args []string) {
+	if len(args) != 1 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: dapper config check")
+		os.Exit(2)
+	}
+
+	readConfigFile()
+
+	problems := api.CheckConfig(context.Background())
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+
+	fmt.Println("Configuration is valid")
+}
+
+// Parses flags given before or after the positional arguments, returning the positional arguments
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,23 @@
+package docs
+
+import (
+	"github.com/gatsby-tv/dapper/api"
+)
+
+// swagger:route GET /janitor janitor-tag janitorReport
+// What the last run of the janitor removed. Requires the admin scope.
+// responses:
+//   200: janitorReport
+//   404: notFound
+
+// swagger:route POST /janitor janitor-tag triggerJanitor
+// Remove orphaned files in the temp video storage folder now. Requires the admin scope.
+// responses:
+//   200: janitorReport
+
+// Files and folders removed by the janitor.
+// swagger:response janitorReport
+type janitorReportResponseWrapper struct {
+	// in:body
+	Body api.JanitorReport
+}
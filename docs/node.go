@@ -0,0 +1,89 @@
+package docs
+
+import (
+	"github.com/gatsby-tv/dapper/api"
+	"github.com/gatsby-tv/dapper/ipfs"
+)
+
+// swagger:route GET /node node-tag nodeStatus
+// Identity, bandwidth, peer count and repo size of the IPFS node, and the disk space reserved by jobs. Requires the admin scope.
+// responses:
+//   200: nodeStatus
+//   502: description: The IPFS node could not be reached
+
+// swagger:response nodeStatus
+type nodeStatusResponseWrapper struct {
+	// in:body
+	Body api.NodeStatusResponse
+}
+
+// swagger:route GET /node/bandwidth node-tag nodeBandwidth
+// Total bandwidth used by the IPFS node. Requires the admin scope.
+// responses:
+//   200: nodeBandwidth
+
+// swagger:response nodeBandwidth
+type nodeBandwidthResponseWrapper struct {
+	// in:body
+	Body ipfs.BandwidthStats
+}
+
+// swagger:route GET /node/bandwidth/peers node-tag nodeBandwidthByPeer
+// Bandwidth used by the IPFS node with each peer, keyed by peer ID. Requires the admin scope.
+// responses:
+//   200: nodeBandwidthByKey
+
+// swagger:route GET /node/bandwidth/protocols node-tag nodeBandwidthByProtocol
+// Bandwidth used by the IPFS node for each protocol, keyed by protocol. Requires the admin scope.
+// responses:
+//   200: nodeBandwidthByKey
+
+// swagger:response nodeBandwidthByKey
+type nodeBandwidthByKeyResponseWrapper struct {
+	// in:body
+	Body map[string]ipfs.BandwidthStats
+}
+
+// swagger:route GET /node/peers node-tag nodePeers
+// Peers the IPFS node is connected to. Requires the admin scope.
+// responses:
+//   200: nodePeers
+
+// swagger:response nodePeers
+type nodePeersResponseWrapper struct {
+	// in:body
+	Body []ipfs.PeerInfo
+}
+
+// swagger:route GET /node/repo node-tag nodeRepo
+// Size of the IPFS node's repo. Requires the admin scope.
+// responses:
+//   200: nodeRepo
+
+// swagger:response nodeRepo
+type nodeRepoResponseWrapper struct {
+	// in:body
+	Body ipfs.RepoStats
+}
+
+// swagger:route GET /node/id node-tag nodeIdentity
+// Identity of the IPFS node. Requires the admin scope.
+// responses:
+//   200: nodeIdentity
+
+// swagger:response nodeIdentity
+type nodeIdentityResponseWrapper struct {
+	// in:body
+	Body ipfs.NodeIdentity
+}
+
+// swagger:route GET /node/disk node-tag nodeDisk
+// Disk usage of the temp video storage folder and the space reserved by each job. Requires the admin scope.
+// responses:
+//   200: nodeDisk
+
+// swagger:response nodeDisk
+type nodeDiskResponseWrapper struct {
+	// in:body
+	Body api.DiskStatus
+}
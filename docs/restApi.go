@@ -29,3 +29,69 @@ type videoEncodingStatusProcessingErrorResponseWrapper struct {
 	// in:body
 	Body api.VideoEncodingStatusResponse
 }
+
+// swagger:route GET /videos listVideos-tag listVideos
+// List the encoding jobs visible to the API key.
+// responses:
+//   200: videoList
+
+// swagger:parameters listVideos
+type listVideosParamsWrapper struct {
+	// Only list jobs created by the API key with this name. Only admin keys can list other keys' jobs.
+	// in:query
+	Key string `json:"key"`
+}
+
+// Encoding jobs ordered by when they were created.
+// swagger:response videoList
+type listVideosSuccessResponseWrapper struct {
+	// in:body
+	Body []api.VideoJobSummary
+}
+
+// swagger:route GET /usage usage-tag usage
+// Usage and limits of API keys.
+// responses:
+//   200: usage
+
+// swagger:parameters usage
+type usageParamsWrapper struct {
+	// Only report the API key with this name. Other keys than admin keys only get their own usage.
+	// in:query
+	Key string `json:"key"`
+}
+
+// Usage of each API key in the current day and month.
+// swagger:response usage
+type usageSuccessResponseWrapper struct {
+	// in:body
+	Body []api.APIKeyUsageResponse
+}
+
+// The API key is over one of its limits.
+// swagger:response quotaExceeded
+type quotaExceededResponseWrapper struct {
+	// in:body
+	Body api.QuotaExceededResponse
+}
+
+// swagger:route GET /metrics metrics-tag metrics
+// Prometheus metrics for jobs, ffmpeg and IPFS, in the Prometheus text format. Requires the admin scope.
+
+// swagger:route GET /healthz health-tag liveness
+// Responds with OK while dapper is running.
+// responses:
+//   200: description: OK
+
+// swagger:route GET /readyz health-tag readiness
+// Checks that ffmpeg, ffprobe, the storage folders and the IPFS node are usable.
+// responses:
+//   200: readiness
+//   503: readiness
+
+// Result of each readiness check.
+// swagger:response readiness
+type readinessResponseWrapper struct {
+	// in:body
+	Body api.ReadinessResponse
+}
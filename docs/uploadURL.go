@@ -0,0 +1,26 @@
+package docs
+
+import (
+	"github.com/gatsby-tv/dapper/api"
+)
+
+// swagger:route POST /upload-url uploadURL-tag uploadURL
+// Issue a short-lived, single use URL a browser can upload a video to without an API key.
+// The video is uploaded to the URL in the same way as a POST to /video.
+// responses:
+//   201: uploadURLSuccess
+//   400: badRequest
+
+// swagger:parameters uploadURL
+type uploadURLParamsWrapper struct {
+	// Constraints the upload must follow.
+	// in:body
+	Body api.UploadURLRequest
+}
+
+// URL and token the video can be uploaded with until it expires.
+// swagger:response uploadURLSuccess
+type uploadURLSuccessResponseWrapper struct {
+	// in:body
+	Body api.UploadURLResponse
+}
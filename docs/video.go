@@ -8,16 +8,35 @@ import (
 
 // swagger:route POST /video videoUpload-tag videoUpload
 // Upload a new video to dapper.
+// Alternatively, a JSON body of VideoPathRequest adds a video already on dapper's filesystem,
+// inside one of the folders in Uploads.AllowedPathRoots. It is transcoded in place and not deleted.
 // responses:
 //   200: success
 //   400: badRequest
+//   403: description: Adding videos from dapper's filesystem is not enabled, or the path is not in an allowed folder.
+//   404: description: The video or thumbnail file does not exist.
+//   413: rejected
+//   415: rejected
+//   422: rejected
+//   429: quotaExceeded
 //   500: processingError
+//   503: description: dapper is shutting down and not accepting uploads
+//   507: rejected
 
 // swagger:parameters videoUpload
 type videoUploadParamsWrapper struct {
 	// Video file to upload
 	// in:form
 	Video multipart.File `json:"video"`
+
+	// Name of the encoding profile from the config file to transcode the video with.
+	// Uses the "default" profile if not given.
+	// in:form
+	Profile string `json:"profile"`
+
+	// Upload token from POST /upload-url, used instead of an API key.
+	// in:query
+	Token string `json:"token"`
 }
 
 // Video has been queued for upload and is accessible with the given ID.
@@ -34,9 +53,69 @@ type videoUploadBadRequestResponseWrapper struct {
 	Error string
 }
 
+// The video was probed and cannot or may not be transcoded.
+// swagger:response rejected
+type videoUploadRejectedResponseWrapper struct {
+	// in:body
+	Body api.VideoRejectedResponse
+}
+
 // An internal error occurred while trying to queue the video for encoding.
 // swagger:response processingError
 type videoUploadProcessingErrorResponseWrapper struct {
 	// in:body
 	Error string
 }
+
+// swagger:route DELETE /video videoDelete-tag videoDelete
+// Cancel a video that is encoding, or remove a finished video's job from dapper.
+// responses:
+//   204: description: The job was deleted.
+//   404: notFound
+
+// swagger:parameters videoDelete
+type videoDeleteParamsWrapper struct {
+	// ID of the video to delete.
+	// in:query
+	ID string `json:"id"`
+}
+
+// No job with the given ID is visible to the API key.
+// swagger:response notFound
+type videoDeleteNotFoundResponseWrapper struct {
+	// in:body
+	Error string
+}
+
+// swagger:route POST /video/import videoImport-tag videoImport
+// Re-encode a video already on IPFS, given the CID of a video file or of a folder transcoded by dapper.
+// The video is fetched and transcoded in the background. Its status gives the new CID alongside the source CID.
+// responses:
+//   202: success
+//   400: badRequest
+//   429: quotaExceeded
+//   503: description: dapper is shutting down and not accepting uploads
+
+// swagger:parameters videoImport
+type videoImportParamsWrapper struct {
+	// in:body
+	Body api.VideoImportRequest
+}
+
+// swagger:route POST /video/renditions videoRenditions-tag videoRenditions
+// Add the renditions a published video is missing for an encoding profile, such as a new codec or resolution.
+// Only the missing renditions are transcoded from the original video, and they are patched into the existing folder
+// with an updated master playlist. The job's status gives the new CID alongside the existing CID as sourceCID.
+// responses:
+//   202: success
+//   400: badRequest
+//   403: description: The original file is not in an allowed folder.
+//   404: description: The original file does not exist.
+//   429: quotaExceeded
+//   503: description: dapper is shutting down and not accepting uploads
+
+// swagger:parameters videoRenditions
+type videoRenditionsParamsWrapper struct {
+	// in:body
+	Body api.VideoRenditionsRequest
+}
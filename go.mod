@@ -3,6 +3,7 @@ module github.com/gatsby-tv/dapper
 go 1.16
 
 require (
+	github.com/dustin/go-humanize v1.0.0
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/google/uuid v1.3.0
 	github.com/ipfs/go-ipfs v0.11.0
@@ -10,11 +11,14 @@ require (
 	github.com/ipfs/go-ipfs-files v0.0.9
 	github.com/ipfs/interface-go-ipfs-core v0.5.2
 	github.com/labstack/echo/v4 v4.5.0
+	github.com/libp2p/go-libp2p v0.16.0
 	github.com/libp2p/go-libp2p-core v0.11.0
 	github.com/multiformats/go-multiaddr v0.4.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rogpeppe/go-internal v1.8.0 // indirect
 	github.com/rs/zerolog v1.23.0
 	github.com/spf13/cast v1.4.1 // indirect
 	github.com/spf13/viper v1.8.1
 	golang.org/x/net v0.0.0-20210902165921-8d991716f632 // indirect
+	golang.org/x/sys v0.0.0-20211025112917-711f33c9992c
 )
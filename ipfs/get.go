@@ -0,0 +1,131 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	files "github.com/ipfs/go-ipfs-files"
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// Get content from IPFS
+
+// Checks that the given path is a CID, optionally followed by a path inside it such as "<cid>/master.m3u8"
+func ValidatePath(ipfsPath string) error {
+	return icorepath.New("/ipfs/" + ipfsPath).IsValid()
+}
+
+// Size in bytes of the file at the given CID, or path inside a CID, without fetching its content
+func FileSize(ctx context.Context, ipfsPath string) (int64, error) {
+	if useExistingIPFSNode {
+		return remoteFileSize(ctx, ipfsPath)
+	}
+	return dapperFileSize(ctx, ipfsPath)
+}
+
+// Fetches the file at the given CID, or path inside a CID, and writes it to destFile.
+// Fails without keeping the file if it is larger than maxBytes.
+func GetFile(ctx context.Context, ipfsPath, destFile string, maxBytes int64) error {
+	var content io.ReadCloser
+	var err error
+	if useExistingIPFSNode {
+		content, err = catRemoteFile(ctx, ipfsPath)
+	} else {
+		content, err = catDapperFile(ctx, ipfsPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	file, err := os.Create(destFile)
+	if err != nil {
+		return err
+	}
+
+	// Read one byte past the limit, so content larger than it can be told apart from content that fits exactly
+	written, err := io.Copy(file, io.LimitReader(content, maxBytes+1))
+	if err == nil && written > maxBytes {
+		err = fmt.Errorf("%s is larger than %d bytes", ipfsPath, maxBytes)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destFile)
+		return err
+	}
+
+	return nil
+}
+
+// Private Functions
+
+func catDapperFile(ctx context.Context, ipfsPath string) (io.ReadCloser, error) {
+	node, err := ipfs.Unixfs().Get(ctx, icorepath.New("/ipfs/"+ipfsPath))
+	if err != nil {
+		return nil, err
+	}
+
+	file, ok := node.(files.File)
+	if !ok {
+		node.Close()
+		return nil, fmt.Errorf("%s is a folder, not a file", ipfsPath)
+	}
+	return file, nil
+}
+
+func dapperFileSize(ctx context.Context, ipfsPath string) (int64, error) {
+	node, err := ipfs.Unixfs().Get(ctx, icorepath.New("/ipfs/"+ipfsPath))
+	if err != nil {
+		return 0, err
+	}
+	defer node.Close()
+
+	if _, ok := node.(files.File); !ok {
+		return 0, fmt.Errorf("%s is a folder, not a file", ipfsPath)
+	}
+	return node.Size()
+}
+
+// Stats the file on the existing node, which only fetches the root block of the file
+func remoteFileSize(ctx context.Context, ipfsPath string) (int64, error) {
+	stat := struct {
+		Size int64
+		Type string
+	}{}
+	if err := remoteAPIRequest(ctx, "files/stat", url.Values{"arg": {"/ipfs/" + ipfsPath}}, &stat); err != nil {
+		return 0, err
+	}
+
+	if stat.Type != "file" {
+		return 0, fmt.Errorf("%s is a folder, not a file", ipfsPath)
+	}
+	return stat.Size, nil
+}
+
+// Streams the file from the existing node, which has no timeout since large videos can take a long time to fetch
+func catRemoteFile(ctx context.Context, ipfsPath string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ipfsURI+"/api/v0/cat?"+url.Values{"arg": {"/ipfs/" + ipfsPath}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("IPFS cat failed with status %d: %s", res.StatusCode, string(body))
+	}
+
+	return res.Body, nil
+}
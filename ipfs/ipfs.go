@@ -37,6 +37,9 @@ var Reporter *metrics.BandwidthCounter
 // IPFS node object
 var ipfs icore.CoreAPI
 
+// The embedded IPFS node, nil when using an existing node
+var node *core.IpfsNode
+
 // Whether or not an existing IPFS node should be used for pinning
 var useExistingIPFSNode bool
 
@@ -126,14 +129,15 @@ func createNode(ctx context.Context, repoPath string) (icore.CoreAPI, error) {
 		Repo: repo,
 	}
 
-	node, err := core.NewNode(ctx, nodeOptions)
+	ipfsNode, err := core.NewNode(ctx, nodeOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	Reporter = node.Reporter
+	node = ipfsNode
+	Reporter = ipfsNode.Reporter
 
-	return coreapi.NewCoreAPI(node)
+	return coreapi.NewCoreAPI(ipfsNode)
 }
 
 func spawnNode(ctx context.Context, ipfsRepoPath string) (icore.CoreAPI, error) {
@@ -524,6 +528,18 @@ func StartIPFS(ctx context.Context) error {
 	return nil
 }
 
+// Waits for the embedded node to close once the context given to StartIPFS is cancelled, or until ctx is done
+func WaitForClose(ctx context.Context) {
+	if node == nil {
+		return
+	}
+
+	select {
+	case <-node.Context().Done():
+	case <-ctx.Done():
+	}
+}
+
 func checkIPFSDirLocked(ipfsRepo string) (bool, error) {
 	locked, err := fsrepo.LockedByOtherProcess(ipfsRepo)
 	if err != nil {
@@ -0,0 +1,295 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	version "github.com/ipfs/go-ipfs"
+	"github.com/ipfs/go-ipfs/core/corerepo"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+)
+
+// Bandwidth used by the node, totals are in bytes and rates in bytes per second
+type BandwidthStats struct {
+	TotalIn  int64   `json:"totalIn"`
+	TotalOut int64   `json:"totalOut"`
+	RateIn   float64 `json:"rateIn"`
+	RateOut  float64 `json:"rateOut"`
+}
+
+// A peer the node is connected to
+type PeerInfo struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	// "Inbound", "Outbound" or "Unknown"
+	Direction string `json:"direction"`
+	// Empty if the latency to the peer is not known yet
+	Latency string `json:"latency,omitempty"`
+}
+
+// Size of the node's repo in bytes
+type RepoStats struct {
+	RepoSize   uint64 `json:"repoSize"`
+	StorageMax uint64 `json:"storageMax"`
+}
+
+// Identity of the node on the IPFS network
+type NodeIdentity struct {
+	ID              string   `json:"id"`
+	PublicKey       string   `json:"publicKey"`
+	Addresses       []string `json:"addresses"`
+	AgentVersion    string   `json:"agentVersion"`
+	ProtocolVersion string   `json:"protocolVersion"`
+}
+
+// Timeout for requests to an existing IPFS node's API
+const remoteAPITimeout = 30 * time.Second
+
+// Returns the bandwidth used by the node in total
+func GetBandwidth(ctx context.Context) (BandwidthStats, error) {
+	if useExistingIPFSNode {
+		return getRemoteBandwidth(ctx, url.Values{})
+	}
+
+	return toBandwidthStats(Reporter.GetBandwidthTotals()), nil
+}
+
+// Returns the bandwidth used by the node with each peer, keyed by peer ID.
+// An existing node only reports bandwidth for peers it is currently connected to.
+func GetBandwidthByPeer(ctx context.Context) (map[string]BandwidthStats, error) {
+	bandwidth := map[string]BandwidthStats{}
+
+	if useExistingIPFSNode {
+		peers, err := getRemotePeers(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, peer := range peers {
+			stats, err := getRemoteBandwidth(ctx, url.Values{"peer": {peer.ID}})
+			if err != nil {
+				return nil, err
+			}
+			bandwidth[peer.ID] = stats
+		}
+		return bandwidth, nil
+	}
+
+	for peerID, stats := range Reporter.GetBandwidthByPeer() {
+		bandwidth[peerID.Pretty()] = toBandwidthStats(stats)
+	}
+	return bandwidth, nil
+}
+
+// Returns the bandwidth used by the node for each protocol.
+// An existing node only reports bandwidth for protocols with streams currently open.
+func GetBandwidthByProtocol(ctx context.Context) (map[string]BandwidthStats, error) {
+	bandwidth := map[string]BandwidthStats{}
+
+	if useExistingIPFSNode {
+		protocols, err := getRemoteProtocols(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, protocol := range protocols {
+			stats, err := getRemoteBandwidth(ctx, url.Values{"proto": {protocol}})
+			if err != nil {
+				return nil, err
+			}
+			bandwidth[protocol] = stats
+		}
+		return bandwidth, nil
+	}
+
+	for protocol, stats := range Reporter.GetBandwidthByProtocol() {
+		bandwidth[string(protocol)] = toBandwidthStats(stats)
+	}
+	return bandwidth, nil
+}
+
+// Returns the peers the node is connected to, ordered by ID
+func GetPeers(ctx context.Context) ([]PeerInfo, error) {
+	if useExistingIPFSNode {
+		return getRemotePeers(ctx, true)
+	}
+
+	connections, err := ipfs.Swarm().Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []PeerInfo{}
+	for _, connection := range connections {
+		peer := PeerInfo{ID: connection.ID().Pretty(), Address: connection.Address().String(), Direction: connection.Direction().String()}
+		if latency, err := connection.Latency(); err == nil && latency > 0 {
+			peer.Latency = latency.String()
+		}
+		peers = append(peers, peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers, nil
+}
+
+// Returns the size of the node's repo and the most it is allowed to store
+func GetRepoStats(ctx context.Context) (RepoStats, error) {
+	if useExistingIPFSNode {
+		stats := RepoStats{}
+		err := remoteAPIRequest(ctx, "repo/stat", url.Values{"size-only": {"true"}}, &stats)
+		return stats, err
+	}
+
+	size, err := corerepo.RepoSize(ctx, node)
+	if err != nil {
+		return RepoStats{}, err
+	}
+	return RepoStats{RepoSize: size.RepoSize, StorageMax: size.StorageMax}, nil
+}
+
+// Returns the identity of the node
+func GetIdentity(ctx context.Context) (NodeIdentity, error) {
+	if useExistingIPFSNode {
+		identity := NodeIdentity{}
+		err := remoteAPIRequest(ctx, "id", url.Values{}, &identity)
+		return identity, err
+	}
+
+	publicKey, err := crypto.MarshalPublicKey(node.PrivateKey.GetPublic())
+	if err != nil {
+		return NodeIdentity{}, err
+	}
+
+	identity := NodeIdentity{
+		ID:              node.Identity.Pretty(),
+		PublicKey:       base64.StdEncoding.EncodeToString(publicKey),
+		Addresses:       []string{},
+		AgentVersion:    version.GetUserAgentVersion(),
+		ProtocolVersion: identify.LibP2PVersion,
+	}
+	for _, address := range node.PeerHost.Addrs() {
+		identity.Addresses = append(identity.Addresses, address.String()+"/p2p/"+identity.ID)
+	}
+	return identity, nil
+}
+
+// Returns the version of the node, failing if the node is not running or does not answer
+func GetVersion(ctx context.Context) (string, error) {
+	if useExistingIPFSNode {
+		response := struct {
+			Version string `json:"Version"`
+		}{}
+		err := remoteAPIRequest(ctx, "version", url.Values{}, &response)
+		return response.Version, err
+	}
+
+	if node == nil || !node.IsOnline {
+		return "", errors.New("embedded IPFS node is not running")
+	}
+	return version.CurrentVersionNumber, nil
+}
+
+// Private Functions
+
+func toBandwidthStats(stats metrics.Stats) BandwidthStats {
+	return BandwidthStats{TotalIn: stats.TotalIn, TotalOut: stats.TotalOut, RateIn: stats.RateIn, RateOut: stats.RateOut}
+}
+
+// Gets the bandwidth of an existing node, optionally filtered to a `peer` or `proto`
+func getRemoteBandwidth(ctx context.Context, params url.Values) (BandwidthStats, error) {
+	stats := BandwidthStats{}
+	err := remoteAPIRequest(ctx, "stats/bw", params, &stats)
+	return stats, err
+}
+
+type remotePeersResponse struct {
+	Peers []struct {
+		Addr      string `json:"Addr"`
+		Peer      string `json:"Peer"`
+		Latency   string `json:"Latency"`
+		Direction int    `json:"Direction"`
+		Streams   []struct {
+			Protocol string `json:"Protocol"`
+		} `json:"Streams"`
+	} `json:"Peers"`
+}
+
+// Gets the peers of an existing node, with their latency and direction if `details` is set
+func getRemotePeers(ctx context.Context, details bool) ([]PeerInfo, error) {
+	response := remotePeersResponse{}
+	params := url.Values{"latency": {fmt.Sprint(details)}, "direction": {fmt.Sprint(details)}}
+	if err := remoteAPIRequest(ctx, "swarm/peers", params, &response); err != nil {
+		return nil, err
+	}
+
+	peers := []PeerInfo{}
+	for _, remotePeer := range response.Peers {
+		peer := PeerInfo{ID: remotePeer.Peer, Address: remotePeer.Addr, Direction: network.Direction(remotePeer.Direction).String()}
+		if _, err := time.ParseDuration(remotePeer.Latency); err == nil {
+			peer.Latency = remotePeer.Latency
+		}
+		peers = append(peers, peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers, nil
+}
+
+// Gets the protocols an existing node has streams open for
+func getRemoteProtocols(ctx context.Context) ([]string, error) {
+	response := remotePeersResponse{}
+	if err := remoteAPIRequest(ctx, "swarm/peers", url.Values{"streams": {"true"}}, &response); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	protocols := []string{}
+	for _, peer := range response.Peers {
+		for _, stream := range peer.Streams {
+			if stream.Protocol != "" && !seen[stream.Protocol] {
+				seen[stream.Protocol] = true
+				protocols = append(protocols, stream.Protocol)
+			}
+		}
+	}
+
+	sort.Strings(protocols)
+	return protocols, nil
+}
+
+// Calls a command on the API of an existing node and decodes its JSON response
+func remoteAPIRequest(ctx context.Context, command string, params url.Values, response interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, remoteAPITimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ipfsURI+"/api/v0/"+command+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("IPFS %s failed with status %d: %s", command, res.StatusCode, string(body))
+	}
+
+	return json.Unmarshal(body, response)
+}
@@ -0,0 +1,157 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	icorepath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// Response of the object patch commands of an existing node
+type objectPatchResponse struct {
+	Hash string `json:"Hash"`
+}
+
+// Patch folders already on IPFS
+
+// Adds the given local files to the folder at the CID, replacing any files with the same names, and pins the new folder.
+// Only the new files and the folder itself are added, the blocks of the files already in the folder are reused.
+// The files are given as a map of their names in the folder to their paths on disk.
+func PatchFolder(ctx context.Context, folderCID string, files map[string]string) (string, error) {
+	// Patch in a stable order so the same files always give the same CID
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if useExistingIPFSNode {
+		return patchRemoteFolder(ctx, folderCID, names, files)
+	} else {
+		return patchDapperFolder(ctx, folderCID, names, files)
+	}
+}
+
+// Private Functions
+
+func patchDapperFolder(ctx context.Context, folderCID string, names []string, files map[string]string) (string, error) {
+	var folder icorepath.Path = icorepath.New("/ipfs/" + folderCID)
+	for _, name := range names {
+		fileNode, err := getUnixfsNode(files[name])
+		if err != nil {
+			return "", err
+		}
+
+		// The file is not pinned by itself, pinning the patched folder pins it
+		fileCID, err := ipfs.Unixfs().Add(ctx, fileNode)
+		if err != nil {
+			return "", err
+		}
+
+		folder, err = ipfs.Object().AddLink(ctx, folder, name, fileCID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	resolved, err := ipfs.ResolvePath(ctx, folder)
+	if err != nil {
+		return "", err
+	}
+	if err := ipfs.Pin().Add(ctx, resolved); err != nil {
+		return "", err
+	}
+
+	return resolved.Cid().String(), nil
+}
+
+func patchRemoteFolder(ctx context.Context, folderCID string, names []string, files map[string]string) (string, error) {
+	for _, name := range names {
+		fileCID, err := addUnpinnedFileToRemoteIPFS(ctx, files[name])
+		if err != nil {
+			return "", err
+		}
+
+		patched := objectPatchResponse{}
+		if err := remoteAPIRequest(ctx, "object/patch/add-link", url.Values{"arg": {folderCID, name, fileCID}}, &patched); err != nil {
+			return "", err
+		}
+		folderCID = patched.Hash
+	}
+
+	// Pinning fetches any blocks of the folder the node does not have, which can take longer than other commands
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ipfsURI+"/api/v0/pin/add?"+url.Values{"arg": {folderCID}}.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("IPFS pin/add failed with status %d: %s", res.StatusCode, string(body))
+	}
+
+	return folderCID, nil
+}
+
+// Adds a file to the existing node without pinning it
+func addUnpinnedFileToRemoteIPFS(ctx context.Context, file string) (string, error) {
+	fileReader, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fileReader.Close()
+
+	// Stream the form rather than buffering whole segments in memory
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", filepath.Base(file))
+		if err == nil {
+			_, err = io.Copy(part, fileReader)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ipfsURI+"/api/v0/add?pin=false", body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode >= 400 {
+		return "", fmt.Errorf("IPFS add failed with status %d: %s", res.StatusCode, string(responseBody))
+	}
+
+	added := ipfsAddResponse{}
+	if err := json.Unmarshal(responseBody, &added); err != nil {
+		return "", err
+	}
+	return added.Hash, nil
+}
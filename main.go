@@ -3,8 +3,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"path"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -23,26 +28,54 @@ const configFileName = "configuration"
 // Type of config file
 const configFileExtension = "toml"
 
+// How long to wait for the embedded IPFS node to close on shutdown
+const ipfsCloseTimeout = 30 * time.Second
+
 func main() {
+	// Running dapper without a command starts the daemon, as it did before there were commands
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serveCommand(args)
+	case "transcode":
+		transcodeCommand(args)
+	case "add":
+		addCommand(args)
+	case "probe":
+		probeCommand(args)
+	case "config":
+		configCommand(args)
+	case "client":
+		clientCommand(args)
+	case "help":
+		printUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+// Runs the daemon, listening for requests on the port given with `-p`
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	portPtr := flags.Int("p", 10000, "Port to listen for requests on.")
+	flags.Parse(args)
+
 	log.Info().Msgf("Dapper version: %s-%s", CurrentVersionNumber, CurrentCommit)
 	readConfigFile()
 	log.Trace().Msg("Successfully loaded config")
 
-	portPtr := flag.Int("p", 10000, "Port to listen for requests on.")
-	flag.Parse()
-
 	// Verify the given port is a valid port number
 	if *portPtr < 1 || *portPtr > 65535 {
 		log.Fatal().Msg("Invalid port specified.")
 	}
 
-	// Create video scratch path if it does not exist
-	if _, err := os.Stat(path.Join(viper.GetString("Videos.TempVideoStorageFolder"), api.VideoScratchFolder)); os.IsNotExist(err) {
-		err := os.Mkdir(path.Join(viper.GetString("Videos.TempVideoStorageFolder"), api.VideoScratchFolder), 0755)
-		if err != nil {
-			log.Fatal().Msgf("Failed setting up video directory: %s", err)
-		}
-	}
+	setupVideoStorage()
 
 	// Setup memory map for keeping track of videos being processed
 	api.EncodingVideos.Videos = make(map[string]api.EncodingVideo)
@@ -64,7 +97,18 @@ func readConfigFile() {
 		}
 	}
 
-	// Verify necessary config values are set
+	// If none was set, use the one on the path
+	if ffmpegDir := viper.GetString("ffmpeg.ffmpegDir"); ffmpegDir == "" {
+		viper.Set("ffmpeg.ffmpegDir", "ffmpeg")
+	}
+
+	if ffmpegDir := viper.GetString("ffmpeg.ffprobeDir"); ffmpegDir == "" {
+		viper.Set("ffmpeg.ffprobeDir", "ffprobe")
+	}
+}
+
+// Makes sure the temp video storage folder and its scratch folder exist, using a temporary folder if none is configured
+func setupVideoStorage() {
 	if videoDir := viper.GetString("Videos.TempVideoStorageFolder"); videoDir == "" {
 		videoDir, err := os.MkdirTemp(os.TempDir(), "dapper-*")
 		if err != nil {
@@ -73,21 +117,23 @@ func readConfigFile() {
 		viper.Set("Videos.TempVideoStorageFolder", videoDir)
 	}
 
-	// If none was set, use the one on the path
-	if ffmpegDir := viper.GetString("ffmpeg.ffmpegDir"); ffmpegDir == "" {
-		viper.Set("ffmpeg.ffmpegDir", "ffmpeg")
-	}
-
-	if ffmpegDir := viper.GetString("ffmpeg.ffprobeDir"); ffmpegDir == "" {
-		viper.Set("ffmpeg.ffprobeDir", "ffprobe")
+	// Create video scratch path if it does not exist
+	if _, err := os.Stat(path.Join(viper.GetString("Videos.TempVideoStorageFolder"), api.VideoScratchFolder)); os.IsNotExist(err) {
+		err := os.Mkdir(path.Join(viper.GetString("Videos.TempVideoStorageFolder"), api.VideoScratchFolder), 0755)
+		if err != nil {
+			log.Fatal().Msgf("Failed setting up video directory: %s", err)
+		}
 	}
 }
 
-// Setup IPFS and start listening for requests
+// Setup IPFS and start listening for requests until dapper is told to stop
 func startDaemon(port int) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
 	log.Trace().Msg("Setting up IPFS")
 
 	err := ipfs.StartIPFS(ctx)
@@ -95,6 +141,37 @@ func startDaemon(port int) {
 		log.Fatal().Msgf("Failed to start IPFS: %s", err)
 	}
 
+	// The API keys must be loaded before jobs interrupted by the last shutdown are resumed and charged to them
+	server := api.NewServer()
+
+	// Pick up jobs interrupted by the last shutdown
+	api.ResumeJobs()
+
+	// Clean up files left behind by failed jobs
+	go api.StartJanitor(ctx)
+
+	// Queue videos dropped into the watch folder, if there is one
+	go api.StartWatchFolder(ctx)
+
 	log.Info().Msg("Ready for requests")
-	api.HandleRequests(port)
+	go api.HandleRequests(server, port)
+
+	received := <-signals
+	log.Info().Msgf("Received %s, shutting down", received)
+
+	// A second signal skips waiting for jobs
+	go func() {
+		<-signals
+		log.Fatal().Msg("Received second signal, exiting immediately")
+	}()
+
+	api.Shutdown(server, viper.GetDuration("Shutdown.GracePeriod"))
+
+	// Cancelling the context closes the embedded IPFS node
+	cancel()
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), ipfsCloseTimeout)
+	defer closeCancel()
+	ipfs.WaitForClose(closeCtx)
+
+	log.Info().Msg("Shut down")
 }
@@ -0,0 +1,64 @@
+package types
+
+// Encoding telemetry reported by ffmpeg's `-progress` output
+type EncodeProgress struct {
+	// Number of frames encoded so far
+	Frame int64 `json:"frame"`
+	// Frames encoded per second
+	FPS float64 `json:"fps"`
+	// Encoding speed as a multiple of realtime
+	Speed float64 `json:"speed"`
+	// Bitrate of the output so far in kbit/s
+	Bitrate float64 `json:"bitrate"`
+	// Position of the encode in the video in seconds
+	OutTime float64 `json:"outTime"`
+	// Estimated number of seconds until the encode finishes
+	TimeRemaining float64 `json:"timeRemaining"`
+}
+
+// Loudness of a video's audio track measured by the first pass of ffmpeg's `loudnorm` filter
+type LoudnessMeasurement struct {
+	// Integrated loudness in LUFS
+	IntegratedLoudness float64 `json:"integratedLoudness"`
+	// Maximum true peak in dBTP
+	TruePeak float64 `json:"truePeak"`
+	// Loudness range in LU
+	LoudnessRange float64 `json:"loudnessRange"`
+	// Gating threshold in LUFS
+	Threshold float64 `json:"threshold"`
+	// Offset gain applied after normalization in LU
+	TargetOffset float64 `json:"targetOffset"`
+}
+
+// A rung of the ladder chosen for a video by the adaptive analysis pass
+type LadderRung struct {
+	Width  int64 `json:"width"`
+	Height int64 `json:"height"`
+	// Bitrate the rendition is encoded at (ex. "2400k")
+	BitRate string `json:"bitRate"`
+	// SSIM of the samples at the chosen bitrate, against the source scaled to the rung's resolution
+	SSIM float64 `json:"ssim"`
+}
+
+// Objective quality of a rendition, measured against the source after transcoding.
+// Renditions are scaled up to the resolution of the source before they are compared, so the scores of a video's renditions can be compared with each other.
+type RenditionQuality struct {
+	// Media playlist of the rendition in the video folder
+	Playlist string `json:"playlist"`
+	Width    int64  `json:"width"`
+	Height   int64  `json:"height"`
+	BitRate  string `json:"bitRate"`
+	// VMAF score from 0 to 100, if ffmpeg was built with libvmaf
+	VMAF *float64 `json:"vmaf,omitempty"`
+	SSIM float64  `json:"ssim"`
+	// PSNR in dB, capped at maxPSNR for renditions identical to the source
+	PSNR float64 `json:"psnr"`
+}
+
+// Details of a video given by the caller when it is added from dapper's filesystem
+type VideoDetails struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// CID of the thumbnail after it is added to IPFS
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
@@ -0,0 +1,58 @@
+package types
+
+// Metadata of a video file as reported by ffprobe
+type VideoMetadata struct {
+	// Container format (ex. "mov,mp4,m4a,3gp,3g2,mj2")
+	Container string `json:"container"`
+	// Length of the video in seconds
+	Duration float64 `json:"duration"`
+	// Size of the file in bytes
+	Size int64 `json:"size"`
+	// Overall bitrate in bits/s
+	Bitrate  int64             `json:"bitrate"`
+	Streams  []StreamMetadata  `json:"streams"`
+	Chapters []ChapterMetadata `json:"chapters,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// Metadata of a single stream within a video file
+type StreamMetadata struct {
+	Index int `json:"index"`
+	// Type of stream (video, audio, subtitle, data or attachment)
+	Type    string `json:"type"`
+	Codec   string `json:"codec"`
+	Profile string `json:"profile,omitempty"`
+	// Bitrate in bits/s, if the container stores it
+	Bitrate  int64             `json:"bitrate,omitempty"`
+	Language string            `json:"language,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	// Video streams
+	Width          int     `json:"width,omitempty"`
+	Height         int     `json:"height,omitempty"`
+	FrameRate      float64 `json:"frameRate,omitempty"`
+	Frames         int64   `json:"frames,omitempty"`
+	PixelFormat    string  `json:"pixelFormat,omitempty"`
+	ColorRange     string  `json:"colorRange,omitempty"`
+	ColorSpace     string  `json:"colorSpace,omitempty"`
+	ColorTransfer  string  `json:"colorTransfer,omitempty"`
+	ColorPrimaries string  `json:"colorPrimaries,omitempty"`
+	// Clockwise rotation in degrees the video should be displayed with
+	Rotation int `json:"rotation,omitempty"`
+	// Whether the stream is cover art rather than video
+	AttachedPicture bool `json:"attachedPicture,omitempty"`
+
+	// Audio streams
+	SampleRate    int    `json:"sampleRate,omitempty"`
+	Channels      int    `json:"channels,omitempty"`
+	ChannelLayout string `json:"channelLayout,omitempty"`
+}
+
+// A chapter marker within a video file
+type ChapterMetadata struct {
+	// Start of the chapter in seconds
+	Start float64 `json:"start"`
+	// End of the chapter in seconds
+	End   float64 `json:"end"`
+	Title string  `json:"title,omitempty"`
+}
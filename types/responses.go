@@ -0,0 +1,44 @@
+// Package types holds the request and response types of dapper's REST API.
+// It has no dependencies, so clients can decode responses without importing the daemon.
+package types
+
+import "time"
+
+// Response given by dapper to a POST to "/video".
+// Gives the caller the ID of the video within dapper to check its status and get the finished CID.
+type VideoStartEncodingResponse struct {
+	ID string `json:"id"`
+}
+
+// Response given by dapper to a GET to "/status".
+// Gives the caller the status of a running video encoding job.
+// If the job is complete, it returns the CID of the pinned video.
+type VideoEncodingStatusResponse struct {
+	State    string               `json:"state"`
+	Finished bool                 `json:"finished"`
+	Progress int64                `json:"progress"`
+	Encoding *EncodeProgress      `json:"encoding,omitempty"`
+	CID      string               `json:"cid"`
+	Length   int                  `json:"length"`
+	Loudness *LoudnessMeasurement `json:"loudness,omitempty"`
+	Ladder   []LadderRung         `json:"ladder,omitempty"`
+	Quality  []RenditionQuality   `json:"quality,omitempty"`
+	Metadata *VideoMetadata       `json:"metadata,omitempty"`
+	Details  *VideoDetails        `json:"details,omitempty"`
+	// CID the video was imported from, so it can be replaced by the new CID
+	SourceCID string `json:"sourceCID,omitempty"`
+	Error     string `json:"error"`
+}
+
+// Summary of an encoding job, given by dapper in response to a GET to "/videos".
+type VideoJobSummary struct {
+	ID        string    `json:"id"`
+	State     string    `json:"state"`
+	Finished  bool      `json:"finished"`
+	Progress  int64     `json:"progress"`
+	CID       string    `json:"cid,omitempty"`
+	SourceCID string    `json:"sourceCID,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	APIKey    string    `json:"apiKey,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}